@@ -0,0 +1,116 @@
+package flowcontrol
+
+import (
+	"io"
+	"time"
+)
+
+// controller adjusts the rate limit of a Monitor based on feedback from the
+// transfer. The caller must hold the Monitor lock.
+type controller interface {
+	// limit returns the lower of rate and the adaptive limit. Any rate < 1
+	// means unlimited.
+	limit(rate int64) int64
+
+	// sample is called at the end of each sample with the transfer rate.
+	sample(rSample float64)
+
+	// feedback is called with the result of an I/O call that took time d.
+	feedback(err error, d time.Duration)
+}
+
+// adaptiveLimit returns the lower of rate and the adaptive limit cur. Any rate
+// < 1 means unlimited.
+func adaptiveLimit(cur float64, rate int64) int64 {
+	if r := round(cur); rate < 1 || r < rate {
+		return r
+	}
+	return rate
+}
+
+// adaptiveBounds replaces invalid minimum, maximum, and initial adaptive limits
+// with their default values.
+func adaptiveBounds(lo, hi, start *int64) {
+	if *lo < 1 {
+		*lo = 1
+	}
+	if *hi > 0 && *hi < *lo {
+		*hi = *lo
+	}
+	if *start < *lo {
+		*start = *lo
+	} else if *hi > 0 && *start > *hi {
+		*start = *hi
+	}
+}
+
+// congestion returns true if the result of an I/O call indicates congestion.
+func congestion(err error) bool {
+	return err != nil && err != io.EOF
+}
+
+// AIMD configures adaptive rate limiting using additive increase and
+// multiplicative decrease, similar to TCP congestion control. The adaptive limit
+// is raised by Increase at the end of each sample in which the transfer rate
+// was close to the limit, and it is multiplied by Decrease whenever congestion
+// is detected, at most once per sample. Congestion is signaled by an error or a
+// latency above Latency of any write to the underlying writer of a Writer.
+type AIMD struct {
+	Min      int64         // Minimum rate limit (1 if <= 0)
+	Max      int64         // Maximum rate limit (unlimited if <= 0)
+	Initial  int64         // Initial rate limit (Min if <= 0)
+	Increase int64         // Additive increase in bytes per second
+	Decrease float64       // Multiplicative decrease factor (0.5 if not in (0, 1))
+	Latency  time.Duration // Latency threshold (disabled if <= 0)
+}
+
+// adaptiveTrack is the fraction of the adaptive limit that the transfer rate must
+// reach for the limit to be raised. This prevents the limit from growing when
+// the transfer is restricted by something else.
+const adaptiveTrack = 0.8
+
+// aimd is the adaptive rate limiting state of a Monitor.
+type aimd struct {
+	AIMD
+	rate      float64 // Current adaptive limit
+	congested bool    // Flag indicating congestion in the current sample
+}
+
+// WithAIMD enables adaptive rate limiting with the given configuration. The
+// adaptive limit never exceeds the rate passed to Limit, but it is effective
+// even if rate < 1. The current adaptive limit is reported by Status.Limit.
+func WithAIMD(cfg AIMD) Option {
+	adaptiveBounds(&cfg.Min, &cfg.Max, &cfg.Initial)
+	if cfg.Decrease <= 0 || cfg.Decrease >= 1 {
+		cfg.Decrease = 0.5
+	}
+	return func(m *Monitor) {
+		m.ctl = &aimd{AIMD: cfg, rate: float64(cfg.Initial)}
+	}
+}
+
+func (a *aimd) limit(rate int64) int64 {
+	return adaptiveLimit(a.rate, rate)
+}
+
+func (a *aimd) sample(rSample float64) {
+	if !a.congested && rSample >= adaptiveTrack*a.rate {
+		if a.rate += float64(a.Increase); a.Max > 0 && a.rate > float64(a.Max) {
+			a.rate = float64(a.Max)
+		}
+	}
+	a.congested = false
+}
+
+func (a *aimd) feedback(err error, d time.Duration) {
+	if a.congested {
+		return
+	}
+	if !congestion(err) && (a.Latency <= 0 || d <= a.Latency) {
+		return
+	}
+	if a.rate *= a.Decrease; a.rate < float64(a.Min) {
+		a.rate = float64(a.Min)
+	}
+	a.congested = true
+}
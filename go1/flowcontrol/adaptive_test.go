@@ -0,0 +1,69 @@
+package flowcontrol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// slowWriter simulates the latency and errors of a congested link.
+type slowWriter struct {
+	bytes.Buffer
+	c     *ManualClock
+	delay time.Duration
+	err   error
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	w.c.Add(w.delay)
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestAIMD(t *testing.T) {
+	b := make([]byte, 100)
+	c := NewManualClock(clockStart)
+	sw := &slowWriter{c: c}
+	cfg := AIMD{Min: 50, Max: 300, Initial: 100, Increase: 100, Latency: _50ms}
+	w := NewWriter(sw, 0, WithClock(c), WithAIMD(cfg))
+	w.SetBlocking(false)
+
+	want := func(n int, limit int64) {
+		t.Helper()
+		if m, _ := w.Write(b); m != n {
+			t.Fatalf("w.Write(b) expected %v; got %v", n, m)
+		}
+		if s := w.Status(); s.Limit != limit {
+			t.Fatalf("w.Status().Limit expected %v; got %v", limit, s.Limit)
+		}
+		c.Add(_100ms)
+	}
+
+	// Limit increases while the transfer rate tracks it, up to Max
+	want(10, 100)
+	want(20, 200)
+	want(30, 300)
+	want(30, 300)
+
+	// Limit is halved once per sample if the latency is above the threshold
+	sw.delay = 60 * time.Millisecond
+	want(30, 150)
+	sw.delay = 0
+	want(15, 150)
+
+	// Errors also signal congestion, but the limit never drops below Min
+	sw.err = errors.New("congested")
+	want(0, 250)
+	want(0, 125)
+	want(0, 63)
+
+	// Limit is not increased if the rate is restricted by something else
+	sw.err = nil
+	w.SetLimit(20)
+	want(2, 20)
+	w.SetLimit(0)
+	want(5, 50)
+}
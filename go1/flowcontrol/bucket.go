@@ -0,0 +1,73 @@
+package flowcontrol
+
+import (
+	"context"
+	"time"
+)
+
+// WithBurst enables token bucket limiting with a bucket that holds up to size
+// bytes. The bucket starts full and is refilled at the rate passed to Limit.
+// The bucket is never smaller than the number of bytes allowed in one sample,
+// so a burst allowance can only increase the amount of data that may be
+// transferred after a period of inactivity.
+func WithBurst(size int64) Option {
+	return func(m *Monitor) {
+		m.setBurst(size)
+	}
+}
+
+// SetBurst changes the token bucket size to new bytes and returns the previous
+// setting. Token bucket limiting is disabled if new <= 0.
+func (m *Monitor) SetBurst(new int64) (old int64) {
+	m.mu.Lock()
+	old = m.bSize
+	m.setBurst(new)
+	m.mu.Unlock()
+	return
+}
+
+// setBurst changes the bucket size. If the bucket was previously disabled, it
+// starts out full.
+func (m *Monitor) setBurst(size int64) {
+	if size < 0 {
+		size = 0
+	}
+	if m.bSize <= 0 {
+		m.bTokens = float64(size)
+		m.bLast = m.sLast
+	}
+	m.bSize = size
+}
+
+// bucketLimit refills the token bucket at rate bytes per second and returns the
+// number of whole tokens that are currently available. sLimit is the number of
+// bytes allowed in one sample, which determines the minimum bucket size. If
+// block == true, the call waits until at least one token is available or ctx is
+// done.
+func (m *Monitor) bucketLimit(ctx context.Context, now time.Duration, rate, sLimit int64, block bool) (int64, error) {
+	size := float64(m.bSize)
+	if size < float64(sLimit) {
+		size = float64(sLimit)
+	}
+	for {
+		if dt := now - m.bLast; dt > 0 {
+			m.bTokens += float64(rate) * dt.Seconds()
+			m.bLast = now
+		}
+		if m.bTokens > size {
+			m.bTokens = size
+		}
+		if !block || m.bTokens >= 1 || !m.active {
+			break
+		}
+		var err error
+		d := time.Duration((1 - m.bTokens) / float64(rate) * 1e9)
+		if now, err = m.sleep(ctx, d); err != nil {
+			return 0, err
+		}
+	}
+	if m.bTokens < 0 {
+		return 0, nil
+	}
+	return int64(m.bTokens), nil
+}
@@ -0,0 +1,57 @@
+package flowcontrol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestBurst(t *testing.T) {
+	b := make([]byte, 100)
+	c := NewManualClock(clockStart)
+	w := NewWriter(&bytes.Buffer{}, 100, WithClock(c), WithBurst(50))
+	w.SetBlocking(false)
+
+	// Full bucket allows a 50-byte burst (instead of 10 bytes per sample)
+	if n, err := w.Write(b); n != 50 || err != ErrLimit {
+		t.Fatalf("w.Write(b) expected 50 (ErrLimit); got %v (%v)", n, err)
+	}
+
+	// Bucket is refilled at 100 bytes per second while idle
+	c.Add(_300ms)
+	if n, err := w.Write(b); n != 30 || err != ErrLimit {
+		t.Fatalf("w.Write(b) expected 30 (ErrLimit); got %v (%v)", n, err)
+	}
+	c.Add(_100ms)
+	if n, err := w.Write(b); n != 10 || err != ErrLimit {
+		t.Fatalf("w.Write(b) expected 10 (ErrLimit); got %v (%v)", n, err)
+	}
+
+	// Blocking write waits for the bucket to refill
+	w.SetBlocking(true)
+	done := make(chan int)
+	go func() {
+		n, _ := w.Write(b[:2])
+		done <- n
+	}()
+	c.BlockUntil(1)
+	select {
+	case n := <-done:
+		t.Fatalf("w.Write(b[:2]) returned ahead of time (%v)", n)
+	default:
+	}
+	c.Add(20 * time.Millisecond)
+	if n := <-done; n != 2 {
+		t.Fatalf("w.Write(b[:2]) expected 2; got %v", n)
+	}
+
+	// Bucket is never smaller than the per-sample limit
+	if old := w.SetBurst(1); old != 50 {
+		t.Fatalf("w.SetBurst(1) expected 50; got %v", old)
+	}
+	c.Add(_300ms)
+	w.SetBlocking(false)
+	if n, err := w.Write(b); n != 10 || err != ErrLimit {
+		t.Fatalf("w.Write(b) expected 10 (ErrLimit); got %v (%v)", n, err)
+	}
+}
@@ -0,0 +1,164 @@
+package flowcontrol
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the current time and timers to a Monitor. The default Clock
+// uses the time package.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+// WithClock makes the new Monitor use c as its time source.
+func WithClock(c Clock) Option {
+	return func(m *Monitor) {
+		m.clk = c
+	}
+}
+
+// WithResolution sets the resolution of the Monitor clock, which is 20ms by
+// default. All timestamps and durations are truncated to this resolution, the
+// sampling rate is rounded to it, and waits for the rate limit are at least a
+// quarter of it long. High-rate transfers may use a finer resolution, together
+// with a shorter sampling rate and pacing (see WithPacing), to avoid sending
+// data in large per-sample bursts. The resolution is ignored if d <= 0.
+func WithResolution(d time.Duration) Option {
+	return func(m *Monitor) {
+		if d > 0 {
+			m.res = d
+		}
+	}
+}
+
+// stopTimer cancels the timer that delivers to ch if clk supports it (see
+// ManualClock.Stop). It is called when a wait is interrupted before the timer
+// fires.
+func stopTimer(clk Clock, ch <-chan time.Time) {
+	if s, ok := clk.(interface{ Stop(<-chan time.Time) bool }); ok && ch != nil {
+		s.Stop(ch)
+	}
+}
+
+// sysClock implements Clock using the time package.
+type sysClock struct{}
+
+func (sysClock) Now() time.Time                         { return time.Now() }
+func (sysClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (sysClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// ManualClock is a Clock that only advances when Add or Set is called, which
+// makes it possible to test the behavior of a Monitor without any real delays.
+// Sleep and After wait for the clock to be advanced by another goroutine.
+type ManualClock struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	now    time.Time
+	timers []*manualTimer // Pending timers in no particular order
+}
+
+// manualTimer is a pending ManualClock timer.
+type manualTimer struct {
+	when time.Time
+	c    chan time.Time
+}
+
+// NewManualClock returns a new ManualClock set to time t.
+func NewManualClock(t time.Time) *ManualClock {
+	c := &ManualClock{now: t}
+	c.cond.L = &c.mu
+	return c
+}
+
+// Now returns the current time of the clock.
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep blocks until the clock is advanced by at least d.
+func (c *ManualClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// After returns a channel that receives the current time once the clock is
+// advanced by at least d.
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+	} else {
+		c.timers = append(c.timers, &manualTimer{c.now.Add(d), ch})
+		c.cond.Broadcast()
+	}
+	return ch
+}
+
+// Add advances the clock by d and fires all timers that expire in the process.
+func (c *ManualClock) Add(d time.Duration) {
+	c.mu.Lock()
+	c.set(c.now.Add(d))
+	c.mu.Unlock()
+}
+
+// Set advances the clock to time t and fires all timers that expire in the
+// process. The clock is never moved backwards.
+func (c *ManualClock) Set(t time.Time) {
+	c.mu.Lock()
+	c.set(t)
+	c.mu.Unlock()
+}
+
+// Stop cancels the timer that delivers to channel ch, which must have been
+// returned by After. It returns false if the timer has already fired or was
+// stopped. Monitors stop the timers of interrupted waits, so these timers are
+// not counted by BlockUntil.
+func (c *ManualClock) Stop(ch <-chan time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, mt := range c.timers {
+		if mt.c == ch {
+			copy(c.timers[i:], c.timers[i+1:])
+			c.timers[len(c.timers)-1] = nil
+			c.timers = c.timers[:len(c.timers)-1]
+			return true
+		}
+	}
+	return false
+}
+
+// BlockUntil blocks until at least n timers are waiting for the clock to be
+// advanced. This includes the timers of all goroutines blocked in Sleep.
+func (c *ManualClock) BlockUntil(n int) {
+	c.mu.Lock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+	c.mu.Unlock()
+}
+
+// set changes the current time and fires expired timers. The caller must hold
+// c.mu.
+func (c *ManualClock) set(t time.Time) {
+	if t.After(c.now) {
+		c.now = t
+	}
+	timers := c.timers[:0]
+	for _, mt := range c.timers {
+		if mt.when.After(c.now) {
+			timers = append(timers, mt)
+		} else {
+			mt.c <- c.now
+		}
+	}
+	for i := len(timers); i < len(c.timers); i++ {
+		c.timers[i] = nil
+	}
+	c.timers = timers
+}
@@ -0,0 +1,42 @@
+package flowcontrol
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestManualClock(t *testing.T) {
+	c := NewManualClock(clockStart)
+	t1 := c.After(_100ms)
+	t2 := c.After(_50ms)
+
+	// Stopped timers are not counted by BlockUntil and never fire
+	if !c.Stop(t1) || c.Stop(t1) {
+		t.Fatalf("c.Stop(t1) expected true once")
+	}
+	if n := len(c.timers); n != 1 {
+		t.Fatalf("c.timers expected 1 timer; got %v", n)
+	}
+	c.Add(_100ms)
+	select {
+	case <-t1:
+		t.Fatalf("t1 fired after c.Stop(t1)")
+	case <-t2:
+	}
+	if c.Stop(t2) {
+		t.Fatalf("c.Stop(t2) expected false after t2 fired")
+	}
+
+	// Interrupted waits release their timers
+	m := New(0, 0, WithClock(c))
+	m.Update(10)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if n, err := m.LimitContext(ctx, 10, 100, true); n != 0 || err != context.DeadlineExceeded {
+		t.Fatalf("m.LimitContext() expected 0 (%v); got %v (%v)", context.DeadlineExceeded, n, err)
+	}
+	if n := len(c.timers); n != 0 {
+		t.Fatalf("c.timers expected no timers; got %v", n)
+	}
+}
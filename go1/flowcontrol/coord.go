@@ -0,0 +1,309 @@
+package flowcontrol
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrDisconnected is returned by RemoteBackend when the connection to the
+// Coordinator is lost before a response is received.
+var ErrDisconnected = errors.New("flowcontrol: coordinator connection lost")
+
+// coordRequest is a Reserve request sent to a Coordinator.
+type coordRequest struct {
+	ID   uint64 `json:"id"`   // Request ID
+	Key  string `json:"key"`  // Limit key
+	N    int64  `json:"n"`    // Number of bytes to reserve
+	Rate int64  `json:"rate"` // Rate limit in bytes per second
+}
+
+// coordResponse is the response to a coordRequest.
+type coordResponse struct {
+	ID      uint64        `json:"id"`            // Request ID
+	Granted int64         `json:"granted"`       // Number of bytes reserved
+	TTL     time.Duration `json:"ttl"`           // Time remaining in the window
+	Err     string        `json:"err,omitempty"` // Backend error
+}
+
+// Coordinator serves a Backend to RemoteBackend clients over a stream-oriented
+// network, such as TCP. The protocol consists of newline-delimited JSON
+// requests and responses. It is intended for small fleets and tests; the
+// Coordinator is a single point of failure, and it does not authenticate its
+// clients.
+type Coordinator struct {
+	b Backend // Shared state
+
+	mu     sync.Mutex
+	ls     map[net.Listener]struct{} // Active listeners
+	conns  map[net.Conn]struct{}     // Active client connections
+	closed bool                      // Flag indicating that Close was called
+}
+
+// NewCoordinator returns a Coordinator for Backend b.
+func NewCoordinator(b Backend) *Coordinator {
+	return &Coordinator{
+		b:     b,
+		ls:    make(map[net.Listener]struct{}),
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on l and serves requests until l fails or Close
+// is called. It always returns a non-nil error, which is net.ErrClosed after
+// Close.
+func (c *Coordinator) Serve(l net.Listener) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	c.ls[l] = struct{}{}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.ls, l)
+		c.mu.Unlock()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			c.mu.Lock()
+			if c.closed {
+				err = net.ErrClosed
+			}
+			c.mu.Unlock()
+			return err
+		}
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			conn.Close()
+			return net.ErrClosed
+		}
+		c.conns[conn] = struct{}{}
+		c.mu.Unlock()
+		go c.serveConn(conn)
+	}
+}
+
+// Close closes all listeners and client connections.
+func (c *Coordinator) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	for l := range c.ls {
+		l.Close()
+	}
+	for conn := range c.conns {
+		conn.Close()
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// serveConn serves the requests of one client in order.
+func (c *Coordinator) serveConn(conn net.Conn) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.conns, conn)
+		c.mu.Unlock()
+		conn.Close()
+	}()
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	enc := json.NewEncoder(conn)
+	for {
+		var req coordRequest
+		if dec.Decode(&req) != nil {
+			return
+		}
+		resp := coordResponse{ID: req.ID}
+		var err error
+		resp.Granted, resp.TTL, err = c.b.Reserve(context.Background(), req.Key, req.N, req.Rate)
+		if err != nil {
+			resp.Err = err.Error()
+		}
+		if enc.Encode(&resp) != nil {
+			return
+		}
+	}
+}
+
+// RemoteBackend is a Backend that forwards all requests to a Coordinator. It
+// maintains a single connection, which is established on first use and
+// re-established by the next request after a failure. Concurrent requests
+// share the connection without waiting for each other's responses.
+type RemoteBackend struct {
+	network string // Coordinator network
+	addr    string // Coordinator address
+
+	wmu sync.Mutex // Mutex serializing requests written to conn
+
+	mu      sync.Mutex
+	conn    net.Conn                       // Current connection (nil if none)
+	id      uint64                         // Most recent request ID
+	pending map[uint64]chan *coordResponse // Requests waiting for a response
+	closed  bool                           // Flag indicating that Close was called
+}
+
+// NewRemoteBackend returns a Backend for the Coordinator at the given network
+// address (see net.Dial).
+func NewRemoteBackend(network, addr string) *RemoteBackend {
+	return &RemoteBackend{
+		network: network,
+		addr:    addr,
+		pending: make(map[uint64]chan *coordResponse),
+	}
+}
+
+// Reserve implements Backend. It returns ErrDisconnected if the connection is
+// lost while waiting for the response, and errors reported by the Coordinator's
+// Backend unmodified except for their type. If ctx is done while the request is
+// being sent, the connection is closed and re-established by the next request.
+func (r *RemoteBackend) Reserve(ctx context.Context, key string, n, rate int64) (int64, time.Duration, error) {
+	conn, err := r.connect(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	ch := make(chan *coordResponse, 1)
+	r.mu.Lock()
+	if r.conn != conn {
+		r.mu.Unlock()
+		return 0, 0, ErrDisconnected
+	}
+	r.id++
+	id := r.id
+	r.pending[id] = ch
+	r.mu.Unlock()
+	if err = r.send(ctx, conn, &coordRequest{ID: id, Key: key, N: n, Rate: rate}); err != nil {
+		r.drop(conn)
+		return 0, 0, err
+	}
+	select {
+	case resp := <-ch:
+		if resp == nil {
+			return 0, 0, ErrDisconnected
+		} else if resp.Err != "" {
+			return 0, 0, errors.New(resp.Err)
+		}
+		return resp.Granted, resp.TTL, nil
+	case <-ctx.Done():
+		r.mu.Lock()
+		delete(r.pending, id)
+		r.mu.Unlock()
+		return 0, 0, ctx.Err()
+	}
+}
+
+// connect returns the current connection, establishing a new one if necessary.
+// The dial does not hold r.mu, so a slow Coordinator does not block requests
+// that use an existing connection. If several requests dial concurrently, the
+// first connection is kept and the others are closed.
+func (r *RemoteBackend) connect(ctx context.Context) (net.Conn, error) {
+	r.mu.Lock()
+	conn, closed := r.conn, r.closed
+	r.mu.Unlock()
+	if closed {
+		return nil, net.ErrClosed
+	} else if conn != nil {
+		return conn, nil
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, r.network, r.addr)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		conn.Close()
+		return nil, net.ErrClosed
+	} else if r.conn != nil {
+		cur := r.conn
+		r.mu.Unlock()
+		conn.Close()
+		return cur, nil
+	}
+	r.conn = conn
+	r.mu.Unlock()
+	go r.read(conn)
+	return conn, nil
+}
+
+// send writes req to conn. Writes are serialized by r.wmu. The write is
+// interrupted when ctx is done, in which case the connection must be dropped
+// because the request may have been partially written.
+func (r *RemoteBackend) send(ctx context.Context, conn net.Conn, req *coordRequest) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	dl, _ := ctx.Deadline()
+	conn.SetWriteDeadline(dl)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetWriteDeadline(time.Unix(1, 0))
+	})
+	_, err = conn.Write(append(b, '\n'))
+	stop()
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+// Close closes the connection to the Coordinator. Requests that are waiting for
+// a response return ErrDisconnected, and subsequent ones return net.ErrClosed.
+func (r *RemoteBackend) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	conn := r.conn
+	r.mu.Unlock()
+	if conn != nil {
+		r.drop(conn)
+	}
+	return nil
+}
+
+// read delivers responses received on conn until the connection fails.
+func (r *RemoteBackend) read(conn net.Conn) {
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		resp := new(coordResponse)
+		if dec.Decode(resp) != nil {
+			r.drop(conn)
+			return
+		}
+		r.mu.Lock()
+		ch := r.pending[resp.ID]
+		delete(r.pending, resp.ID)
+		r.mu.Unlock()
+		if ch != nil {
+			ch <- resp
+		}
+	}
+}
+
+// drop closes conn and fails all requests that are waiting for a response on
+// it. The next request establishes a new connection.
+func (r *RemoteBackend) drop(conn net.Conn) {
+	r.mu.Lock()
+	if r.conn == conn {
+		r.conn = nil
+		for id, ch := range r.pending {
+			close(ch)
+			delete(r.pending, id)
+		}
+	}
+	r.mu.Unlock()
+	conn.Close()
+}
@@ -0,0 +1,83 @@
+package flowcontrol
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// errBackend is a Backend that always fails.
+type errBackend struct{}
+
+func (errBackend) Reserve(context.Context, string, int64, int64) (int64, time.Duration, error) {
+	return 0, 0, errors.New("backend failure")
+}
+
+func TestCoordinator(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("net.Listen() failed: %v", err)
+	}
+	c := NewManualClock(clockStart)
+	coord := NewCoordinator(NewMemBackend(time.Second, c))
+	served := make(chan error)
+	go func() { served <- coord.Serve(l) }()
+
+	ctx := context.Background()
+	r1 := NewRemoteBackend("tcp", l.Addr().String())
+	r2 := NewRemoteBackend("tcp", l.Addr().String())
+	defer r1.Close()
+	defer r2.Close()
+	for i, want := range []int64{600, 400, 0} {
+		r := r1
+		if i%2 == 1 {
+			r = r2
+		}
+		if n, ttl, err := r.Reserve(ctx, "fleet", 600, 1000); n != want || ttl != time.Second || err != nil {
+			t.Fatalf("r.Reserve() #%v expected %v (1s, <nil>); got %v (%v, %v)", i, want, n, ttl, err)
+		}
+	}
+
+	// A request is not sent when ctx is done, and the connection is replaced
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, _, err := r1.Reserve(cctx, "fleet", 1, 1000); err != context.Canceled {
+		t.Fatalf("r1.Reserve() expected %v; got %v", context.Canceled, err)
+	}
+	if n, _, err := r1.Reserve(ctx, "fleet", 1, 1000); n != 0 || err != nil {
+		t.Fatalf("r1.Reserve() expected 0 (<nil>); got %v (%v)", n, err)
+	}
+
+	// Shared limit with a remote backend
+	s := NewSharedLimit(r1, "fleet", 1000, WithClock(c))
+	c.Add(time.Second)
+	if n, err := s.limitContext(ctx, 5000, true); n != 100 || err != nil {
+		t.Fatalf("s.limitContext() expected 100 (<nil>); got %v (%v)", n, err)
+	}
+
+	// Backend errors are returned to the caller
+	ec := NewCoordinator(errBackend{})
+	el, _ := net.Listen("tcp", "127.0.0.1:0")
+	go ec.Serve(el)
+	defer ec.Close()
+	r3 := NewRemoteBackend("tcp", el.Addr().String())
+	defer r3.Close()
+	if _, _, err := r3.Reserve(ctx, "fleet", 1, 1); err == nil || err.Error() != "backend failure" {
+		t.Fatalf("r3.Reserve() expected backend failure; got %v", err)
+	}
+
+	// Closed coordinator
+	coord.Close()
+	if err := <-served; err != net.ErrClosed {
+		t.Fatalf("coord.Serve() expected %v; got %v", net.ErrClosed, err)
+	}
+	if _, _, err := r1.Reserve(ctx, "fleet", 1, 1000); err == nil {
+		t.Fatalf("r1.Reserve() expected an error after coord.Close()")
+	}
+	r2.Close()
+	if _, _, err := r2.Reserve(ctx, "fleet", 1, 1000); err != net.ErrClosed {
+		t.Fatalf("r2.Reserve() expected %v; got %v", net.ErrClosed, err)
+	}
+}
@@ -0,0 +1,203 @@
+package flowcontrol
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EventType identifies the transfer state change that triggered an Event.
+type EventType int
+
+const (
+	EventStall    EventType = iota + 1 // Transfer idle for longer than Watch.Stall
+	EventResume                        // Transfer resumed after a stall
+	EventProgress                      // Progress reached one of Watch.Milestones
+	EventDone                          // Transfer finished (see Monitor.Done)
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventStall:
+		return "stall"
+	case EventResume:
+		return "resume"
+	case EventProgress:
+		return "progress"
+	case EventDone:
+		return "done"
+	}
+	return "EventType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// Event describes a transfer state change.
+type Event struct {
+	Type      EventType // Event type
+	Milestone Percent   // Progress milestone that was reached (EventProgress only)
+	Status    Status    // Transfer status at the time the event was delivered
+}
+
+// Watch configures the events delivered to a subscriber. EventDone is always
+// delivered.
+type Watch struct {
+	Stall      time.Duration // Idle time before EventStall (disabled if <= 0)
+	Milestones []Percent     // Progress milestones in increasing order
+}
+
+// subscriber is a Monitor event subscription.
+type subscriber struct {
+	Watch
+	fn      func(Event)   // Event callback
+	stalled bool          // Flag indicating that EventStall was delivered
+	next    int           // Index of the next milestone
+	queue   []Event       // Undelivered events (guarded by the Monitor lock)
+	wake    chan struct{} // Signal for new events in the queue
+	stop    chan struct{} // Channel closed when the subscription is canceled
+	once    sync.Once     // Guard for closing stop
+}
+
+// Subscribe calls fn for all events specified by w until the returned cancel
+// function is called. EventStall is delivered once the transfer has been idle
+// for at least w.Stall, and EventResume is delivered when the next byte is
+// transferred after that. EventProgress is delivered for each milestone in
+// w.Milestones that is reached by the overall transfer progress (see
+// SetTransferSize). The subscription ends after EventDone is delivered.
+//
+// Events are delivered in order from a separate goroutine, so fn may call any
+// Monitor methods. A call to fn that is in progress when cancel is called is
+// not interrupted.
+func (m *Monitor) Subscribe(w Watch, fn func(Event)) (cancel func()) {
+	s := &subscriber{
+		Watch: w,
+		fn:    fn,
+		wake:  make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+	}
+	m.mu.Lock()
+	if m.active {
+		m.subs = append(m.subs, s)
+		m.update(0)
+		s.progress(m)
+	} else {
+		s.queue = append(s.queue, Event{Type: EventDone})
+	}
+	m.mu.Unlock()
+	go s.run(m)
+	return func() { m.unsubscribe(s) }
+}
+
+// Notify is like Subscribe, but it sends events to c. Delivery of all
+// subsequent events is blocked until c is ready to receive.
+func (m *Monitor) Notify(c chan<- Event, w Watch) (cancel func()) {
+	stop := make(chan struct{})
+	unsubscribe := m.Subscribe(w, func(e Event) {
+		select {
+		case c <- e:
+		case <-stop:
+		}
+	})
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(stop) })
+		unsubscribe()
+	}
+}
+
+// unsubscribe cancels subscription s.
+func (m *Monitor) unsubscribe(s *subscriber) {
+	m.mu.Lock()
+	for i, sub := range m.subs {
+		if sub == s {
+			m.subs = append(m.subs[:i], m.subs[i+1:]...)
+			break
+		}
+	}
+	m.mu.Unlock()
+	s.once.Do(func() { close(s.stop) })
+}
+
+// notify is called by update after the transfer of at least 1 byte. The caller
+// must hold the Monitor lock.
+func (m *Monitor) notify() {
+	for _, s := range m.subs {
+		if s.stalled {
+			s.stalled = false
+			s.post(Event{Type: EventResume})
+		}
+		s.progress(m)
+	}
+}
+
+// notifyDone is called by Done to end all subscriptions. The caller must hold
+// the Monitor lock.
+func (m *Monitor) notifyDone() {
+	for _, s := range m.subs {
+		s.post(Event{Type: EventDone})
+	}
+	m.subs = nil
+}
+
+// post queues event e for delivery. The caller must hold the Monitor lock.
+func (s *subscriber) post(e Event) {
+	s.queue = append(s.queue, e)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// progress queues EventProgress for all milestones that have been reached. The
+// caller must hold the Monitor lock.
+func (s *subscriber) progress(m *Monitor) {
+	if s.next >= len(s.Milestones) || m.tBytes <= 0 {
+		return
+	}
+	p := percentOf(float64(m.tOff+m.bytes+m.sBytes), float64(m.tBytes))
+	for ; s.next < len(s.Milestones) && p >= s.Milestones[s.next]; s.next++ {
+		s.post(Event{Type: EventProgress, Milestone: s.Milestones[s.next]})
+	}
+}
+
+// run delivers events and detects stalls until the subscription is canceled or
+// EventDone is delivered. At most one stall timer is pending at any given time.
+func (s *subscriber) run(m *Monitor) {
+	var timer <-chan time.Time
+	defer func() { stopTimer(m.clk, timer) }()
+	for {
+		m.mu.Lock()
+		q := s.queue
+		s.queue = nil
+		if s.Stall > 0 && m.active && !s.stalled && timer == nil {
+			if idle := m.update(0) - m.tLast; idle >= s.Stall {
+				s.stalled = true
+				q = append(q, Event{Type: EventStall})
+			} else {
+				timer = m.clk.After(s.Stall - idle)
+			}
+		}
+		m.mu.Unlock()
+		for _, e := range q {
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+			e.Status = m.Status()
+			s.fn(e)
+			if e.Type == EventDone {
+				return
+			}
+		}
+		if len(q) > 0 {
+			continue
+		}
+		select {
+		case <-timer:
+			timer = nil
+		case <-s.wake:
+		case <-s.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package flowcontrol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	c := NewManualClock(clockStart)
+	m := New(_100ms, time.Second, WithClock(c))
+	m.SetTransferSize(100)
+	events := make(chan Event, 10)
+	cancel := m.Notify(events, Watch{Stall: time.Second, Milestones: []Percent{50000, 100000}})
+	defer cancel()
+	expect := func(typ EventType, milestone Percent) {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e.Type != typ || e.Milestone != milestone {
+				t.Fatalf("expected %v event (%v); got %v (%v)", typ, milestone, e.Type, e.Milestone)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %v event; got nothing", typ)
+		}
+	}
+
+	c.BlockUntil(1) // Stall timer
+	m.Update(60)
+	expect(EventProgress, 50000)
+
+	// Idle for the stall threshold
+	c.Add(time.Second)
+	expect(EventStall, 0)
+
+	// Transfer resumes and completes
+	m.Update(40)
+	expect(EventResume, 0)
+	expect(EventProgress, 100000)
+	m.Done()
+	expect(EventDone, 0)
+
+	// Subscribing to a finished transfer delivers EventDone immediately
+	done := make(chan Status)
+	m.Subscribe(Watch{}, func(e Event) {
+		if e.Type == EventDone {
+			done <- e.Status
+		}
+	})
+	select {
+	case s := <-done:
+		if s.Active || s.Bytes != 100 {
+			t.Fatalf("EventDone expected inactive status with 100 bytes; got %v", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected EventDone")
+	}
+}
@@ -0,0 +1,239 @@
+package flowcontrol
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FastMonitor is a Monitor for hot paths with many concurrent callers, such as
+// small writes to a fast link from many goroutines. Update and Limit do not
+// acquire any locks in the common case. Transferred bytes are accumulated in
+// sharded atomic counters and folded into an underlying Monitor once per
+// sample, either by the first call after the sample ends or by Status, so the
+// Status semantics are the same as those of a Monitor.
+//
+// Limit grants bytes from an atomic per-sample allowance of rate * sampleRate
+// bytes, which is reset at the end of each sample. Unlike Monitor.Limit, the
+// allowance is consumed when the bytes are granted rather than when they are
+// reported by Update. Monitor options that affect Limit, such as token buckets,
+// pacing, adaptive limits, groups, hierarchies, quotas, and shared limits, are
+// not supported.
+type FastMonitor struct {
+	m      *Monitor    // Underlying Monitor
+	clk    Clock       // Time source
+	sRate  int64       // Sampling rate in nanoseconds
+	shards []fastShard // Byte counters since the most recent flush
+	mask   uint32      // Shard index mask
+
+	mu    sync.Mutex   // Mutex held while flushing the shards
+	next  atomic.Int64 // End time of the current sample (Unix nanoseconds)
+	avail atomic.Int64 // Remaining Limit allowance in the current sample
+	rate  atomic.Int64 // Rate of the most recent Limit call
+
+	wCount atomic.Int64 // Number of Limit calls that waited for the rate limit
+	wTime  atomic.Int64 // Total time spent waiting for the rate limit
+	lShort atomic.Int64 // Number of Limit calls that returned less than want
+	lZero  atomic.Int64 // Number of non-blocking Limit calls that returned 0
+}
+
+// fastShard is a byte counter padded to occupy its own cache line.
+type fastShard struct {
+	n atomic.Int64 // Number of bytes transferred
+	t atomic.Int64 // Time of the most recent Update (Unix nanoseconds)
+	_ [48]byte
+}
+
+// NewFast creates a new FastMonitor. The arguments are the same as those of
+// New, except that opts may not include any option that affects Limit:
+// WithBurst, WithPacing, WithAIMD, WithScavenger, WithGroup, WithParent,
+// WithQuota, or WithShared. NewFast panics if they do.
+func NewFast(sampleRate, windowSize time.Duration, opts ...Option) *FastMonitor {
+	n := 1
+	for n < 4*runtime.GOMAXPROCS(0) {
+		n <<= 1
+	}
+	m := New(sampleRate, windowSize, opts...)
+	if m.bSize > 0 || m.pSize > 0 || m.ctl != nil ||
+		m.group != nil || m.parent != nil || m.quota != nil || m.shared != nil {
+		m.Done()
+		panic("flowcontrol: unsupported FastMonitor option")
+	}
+	f := &FastMonitor{
+		m:      m,
+		clk:    m.clk,
+		sRate:  int64(m.sRate),
+		shards: make([]fastShard, n),
+		mask:   uint32(n - 1),
+	}
+	f.next.Store(clockToTime(m.sLast + m.sRate).UnixNano())
+	return f
+}
+
+// Update records the transfer of n bytes and returns n.
+func (f *FastMonitor) Update(n int) int {
+	now := f.clk.Now().UnixNano()
+	if n > 0 {
+		s := &f.shards[rand.Uint32()&f.mask]
+		s.n.Add(int64(n))
+		s.t.Store(now)
+	}
+	f.tick(now)
+	return n
+}
+
+// IO is a convenience method intended to wrap io.Reader and io.Writer method
+// execution. It calls f.Update(n) and then returns (n, err) unmodified.
+func (f *FastMonitor) IO(n int, err error) (int, error) {
+	return f.Update(n), err
+}
+
+// Done marks the transfer as finished and returns the total number of bytes
+// transferred.
+func (f *FastMonitor) Done() int64 {
+	f.mu.Lock()
+	f.flush()
+	f.next.Store(math.MaxInt64)
+	f.mu.Unlock()
+	return f.m.Done()
+}
+
+// Status returns current transfer status information.
+func (f *FastMonitor) Status() Status {
+	f.mu.Lock()
+	f.flush()
+	f.mu.Unlock()
+	s := f.m.Status()
+	s.Waits = f.wCount.Load()
+	s.WaitTime = time.Duration(f.wTime.Load())
+	s.Limited = f.lShort.Load()
+	s.Denied = f.lZero.Load()
+	s.Limit = f.rate.Load()
+	return s
+}
+
+// SetTransferSize specifies the total size of the data transfer.
+func (f *FastMonitor) SetTransferSize(bytes int64) {
+	f.m.SetTransferSize(bytes)
+}
+
+// Limit restricts the data flow to rate bytes per second in the same way as
+// Monitor.Limit.
+func (f *FastMonitor) Limit(want int, rate int64, block bool) (n int) {
+	n, _ = f.LimitContext(context.Background(), want, rate, block)
+	return
+}
+
+// LimitContext is like Limit, but it returns (0, ctx.Err()) if ctx is done
+// before any bytes may be transferred.
+func (f *FastMonitor) LimitContext(ctx context.Context, want int, rate int64, block bool) (int, error) {
+	if want < 1 {
+		return want, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if rate < 1 {
+		if f.rate.Load() != 0 {
+			f.rate.Store(0)
+		}
+		return want, nil
+	}
+	if old := f.rate.Load(); old != rate && f.rate.CompareAndSwap(old, rate) && old <= 0 {
+		f.avail.Store(f.allowance(rate)) // Start with a full allowance
+	}
+	waited := false
+	for {
+		now := f.clk.Now().UnixNano()
+		f.tick(now)
+		next := f.next.Load()
+		if next == math.MaxInt64 {
+			return want, nil // Inactive
+		}
+		if a := f.avail.Load(); a > 0 {
+			n := int64(want)
+			if n > a {
+				n = a
+			}
+			if !f.avail.CompareAndSwap(a, a-n) {
+				continue
+			}
+			if waited {
+				f.wCount.Add(1)
+			}
+			if n < int64(want) {
+				f.lShort.Add(1)
+			}
+			return int(n), nil
+		}
+		if !block {
+			f.lShort.Add(1)
+			f.lZero.Add(1)
+			return 0, nil
+		}
+		waited = true
+		start := f.clk.Now()
+		timer := f.clk.After(time.Duration(next - now))
+		select {
+		case <-timer:
+			f.wTime.Add(int64(f.clk.Now().Sub(start)))
+		case <-ctx.Done():
+			stopTimer(f.clk, timer)
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// tick flushes the shards if the current sample has ended at time now.
+func (f *FastMonitor) tick(now int64) {
+	if now >= f.next.Load() && f.mu.TryLock() {
+		if now >= f.next.Load() {
+			f.flush()
+		}
+		f.mu.Unlock()
+	}
+}
+
+// flush moves the shard counters to the underlying Monitor and starts a new
+// Limit allowance if the sample has ended. The caller must hold f.mu.
+func (f *FastMonitor) flush() {
+	var n, last int64
+	for i := range f.shards {
+		s := &f.shards[i]
+		if s.n.Load() != 0 {
+			n += s.n.Swap(0)
+		}
+		if t := s.t.Load(); t > last {
+			last = t
+		}
+	}
+	m := f.m
+	m.mu.Lock()
+	if m.update(int(n)); n > 0 && m.active {
+		m.tLast = timeToClock(time.Unix(0, last), m.res)
+	}
+	next, active := clockToTime(m.sLast+m.sRate).UnixNano(), m.active
+	m.mu.Unlock()
+	if !active {
+		next = math.MaxInt64
+	}
+	if next != f.next.Load() {
+		f.next.Store(next)
+		if rate := f.rate.Load(); rate > 0 {
+			f.avail.Store(f.allowance(rate))
+		}
+	}
+}
+
+// allowance returns the number of bytes that may be transferred in one sample
+// at the given rate.
+func (f *FastMonitor) allowance(rate int64) int64 {
+	if n := round(float64(rate) * float64(f.sRate) / 1e9); n > 0 {
+		return n
+	}
+	return 1
+}
@@ -0,0 +1,125 @@
+package flowcontrol
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFastMonitor(t *testing.T) {
+	c := NewManualClock(clockStart)
+	m := New(_100ms, time.Second, WithClock(c))
+	f := NewFast(_100ms, time.Second, WithClock(c))
+	m.SetTransferSize(1000)
+	f.SetTransferSize(1000)
+
+	// Concurrent updates within a sample produce the same status as a Monitor
+	for _, n := range []int{100, 0, 250, 50} {
+		c.Add(_50ms)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				f.Update(n / 10)
+			}()
+		}
+		m.Update(n)
+		wg.Wait()
+		c.Add(_50ms)
+		if ms, fs := m.Status(), f.Status(); !reflect.DeepEqual(ms, fs) {
+			t.Fatalf("f.Status() expected %v; got %v", ms, fs)
+		}
+	}
+	if mn, fn := m.Done(), f.Done(); mn != fn || fn != 400 {
+		t.Fatalf("f.Done() expected %v; got %v", mn, fn)
+	}
+	if ms, fs := m.Status(), f.Status(); !reflect.DeepEqual(ms, fs) {
+		t.Fatalf("f.Status() expected %v; got %v", ms, fs)
+	}
+}
+
+func TestFastMonitorLimit(t *testing.T) {
+	c := NewManualClock(clockStart)
+	f := NewFast(_100ms, time.Second, WithClock(c))
+
+	// 100 bytes per second allows 10 bytes per sample
+	if n := f.Limit(100, 100, false); n != 10 {
+		t.Fatalf("f.Limit(100, 100, false) expected 10; got %v", n)
+	}
+	if n := f.Limit(100, 100, false); n != 0 {
+		t.Fatalf("f.Limit(100, 100, false) expected 0; got %v", n)
+	}
+	done := make(chan int)
+	go func() { done <- f.Limit(5, 100, true) }()
+	advance(c, _100ms)
+	if n := <-done; n != 5 {
+		t.Fatalf("f.Limit(5, 100, true) expected 5; got %v", n)
+	}
+	if n := f.Limit(100, 0, false); n != 100 {
+		t.Fatalf("f.Limit(100, 0, false) expected 100; got %v", n)
+	}
+	s := f.Status()
+	if s.Waits != 1 || s.WaitTime != _100ms || s.Limited != 2 || s.Denied != 1 || s.Limit != 0 {
+		t.Fatalf("f.Status() expected 1 wait (100ms), 2 limited, 1 denied; got %v", s)
+	}
+	f.Done()
+	if n := f.Limit(100, 100, true); n != 100 {
+		t.Fatalf("f.Limit(100, 100, true) expected 100 after Done; got %v", n)
+	}
+}
+
+// benchmarkUpdate measures the cost of concurrent Update and Limit calls.
+func benchmarkUpdate(b *testing.B, update func(n int) int, limit func(want int, rate int64, block bool) int) {
+	b.SetBytes(64)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			update(limit(64, 0, false))
+		}
+	})
+}
+
+func BenchmarkMonitorUpdate(b *testing.B) {
+	m := New(0, 0)
+	benchmarkUpdate(b, m.Update, m.Limit)
+}
+
+func BenchmarkFastMonitorUpdate(b *testing.B) {
+	f := NewFast(0, 0)
+	benchmarkUpdate(b, f.Update, f.Limit)
+}
+
+func BenchmarkMonitorLimit(b *testing.B) {
+	m := New(0, 0)
+	benchmarkUpdate(b, m.Update, func(want int, _ int64, _ bool) int {
+		return m.Limit(want, 1<<40, false)
+	})
+}
+
+func BenchmarkFastMonitorLimit(b *testing.B) {
+	f := NewFast(0, 0)
+	benchmarkUpdate(b, f.Update, func(want int, _ int64, _ bool) int {
+		return f.Limit(want, 1<<40, false)
+	})
+}
+
+func TestFastMonitorOptions(t *testing.T) {
+	g := NewGroup(100)
+	for i, opt := range []Option{WithBurst(100), WithPacing(100),
+		WithAIMD(AIMD{}), WithScavenger(Scavenger{}), WithGroup(g),
+		WithParent(NewTree("root", 100)), WithQuota(&Quota{}),
+		WithShared(NewSharedLimit(nil, "", 0))} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewFast(opts[%v]) expected a panic", i)
+				}
+			}()
+			NewFast(0, 0, opt)
+		}()
+	}
+	if n := g.Len(); n != 0 {
+		t.Errorf("g.Len() expected 0 after NewFast panicked; got %v", n)
+	}
+}
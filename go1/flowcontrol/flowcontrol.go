@@ -7,6 +7,7 @@
 package flowcontrol
 
 import (
+	"context"
 	"math"
 	"sync"
 	"time"
@@ -15,8 +16,10 @@ import (
 // Monitor monitors and limits the transfer rate of a data stream.
 type Monitor struct {
 	mu      sync.Mutex    // Mutex guarding access to all internal fields
+	clk     Clock         // Time source
+	res     time.Duration // Clock resolution
 	active  bool          // Flag indicating an active transfer
-	start   time.Duration // Transfer start time (clock() value)
+	start   time.Duration // Transfer start time (m.clock() value)
 	bytes   int64         // Total number of bytes transferred
 	samples int64         // Total number of samples taken
 
@@ -30,9 +33,42 @@ type Monitor struct {
 	sRate  time.Duration // Sampling rate
 
 	tBytes int64         // Number of bytes expected in the current transfer
+	tOff   int64         // Number of bytes transferred before the Monitor was created
 	tLast  time.Duration // Time of the most recent transfer of at least 1 byte
+
+	bSize   int64         // Token bucket size (disabled when <= 0)
+	bTokens float64       // Number of bytes currently available in the bucket
+	bLast   time.Duration // Most recent bucket refill time
+
+	pSize int64     // Pacing quantum (disabled when <= 0)
+	pNext time.Time // Earliest start time of the next paced transfer
+
+	group  *Group        // Group sharing an aggregate rate limit (nil if none)
+	weight float64       // Relative weight within the group
+	ctl    controller    // Adaptive rate limiting (nil if disabled)
+	parent *Node         // Node with the enclosing rate limits (nil if none)
+	quota  *Quota        // Transfer quota (nil if none)
+	shared *SharedLimit  // Rate limit shared with other processes (nil if none)
+	subs   []*subscriber // Event subscribers
+
+	wCount int64         // Number of Limit calls that waited for the rate limit
+	wTime  time.Duration // Total time spent waiting for the rate limit
+
+	lRate  int64 // Effective rate limit of the most recent Limit call
+	lShort int64 // Number of Limit calls that returned less than want
+	lZero  int64 // Number of non-blocking Limit calls that returned 0
+	dCount int64 // Number of datagrams dropped by policing
+
+	ioCalls int64           // Number of I/O calls with a recorded latency
+	ioEMA   time.Duration   // Exponential moving average of I/O call latency
+	ioHist  []time.Duration // Latencies of the most recent latHist I/O calls
+	ioSort  []time.Duration // Sorted copy of ioHist (empty until recalculated)
 }
 
+// Option configures optional Monitor behavior. Options may be passed to New,
+// NewReader, and NewWriter.
+type Option func(*Monitor)
+
 // New creates a new flow control monitor. Instantaneous transfer rate is
 // measured and updated for each sampleRate interval. windowSize determines the
 // weight of each sample in the exponential moving average (EMA) calculation.
@@ -44,23 +80,32 @@ type Monitor struct {
 // 	newRate    = weight*sampleRate + (1-weight)*oldRate
 //
 // The default values for sampleRate and windowSize (if <= 0) are 100ms and 1s,
-// respectively.
-func New(sampleRate, windowSize time.Duration) *Monitor {
-	if sampleRate = clockRound(sampleRate); sampleRate <= 0 {
-		sampleRate = 5 * clockRate
-	}
+// respectively. sampleRate is rounded to the nearest multiple of the clock
+// resolution (see WithResolution). opts are applied in order after the defaults
+// are set.
+func New(sampleRate, windowSize time.Duration, opts ...Option) *Monitor {
 	if windowSize <= 0 {
 		windowSize = 1 * time.Second
 	}
-	now := clock()
-	return &Monitor{
+	m := &Monitor{
+		clk:     sysClock{},
+		res:     clockRate,
 		active:  true,
-		start:   now,
 		rWindow: windowSize.Seconds(),
-		sLast:   now,
-		sRate:   sampleRate,
-		tLast:   now,
+		weight:  defaultWeight,
+	}
+	for _, opt := range opts {
+		opt(m)
 	}
+	if m.sRate = clockRound(sampleRate, m.res); m.sRate <= 0 {
+		m.sRate = 5 * clockRate
+	}
+	now := m.clock()
+	m.start, m.sLast, m.tLast, m.bLast = now, now, now, now
+	if m.group != nil {
+		m.group.add(m)
+	}
+	return m
 }
 
 // Update records the transfer of n bytes and returns n. It should be called
@@ -86,8 +131,13 @@ func (m *Monitor) Done() int64 {
 	if now := m.update(0); m.sBytes > 0 {
 		m.reset(now)
 	}
+	if m.group != nil {
+		m.group.remove(m)
+		m.group = nil
+	}
 	m.active = false
 	m.tLast = 0
+	m.notifyDone()
 	n := m.bytes
 	m.mu.Unlock()
 	return n
@@ -112,6 +162,20 @@ type Status struct {
 	BytesRem int64         // Number of bytes remaining in the transfer
 	TimeRem  time.Duration // Estimated time to completion
 	Progress Percent       // Overall transfer progress
+	Waits    int64         // Number of Limit calls that waited for the rate limit
+	WaitTime time.Duration // Total time spent waiting for the rate limit
+	Limited  int64         // Number of Limit calls that returned less than want
+	Denied   int64         // Number of non-blocking Limit calls that returned 0
+	Limit    int64         // Effective rate limit of the most recent Limit call
+
+	// I/O call latency statistics, which are only recorded by Writer. The
+	// percentiles are calculated for the most recent calls.
+	Latency    time.Duration // EMA of the latency
+	LatencyP50 time.Duration // Median latency
+	LatencyP99 time.Duration // 99th percentile latency
+
+	QuotaRem int64 // Remaining transfer quota (-1 if unlimited)
+	Dropped  int64 // Number of datagrams dropped by policing (see Packets)
 }
 
 // Status returns current transfer status information. The returned value
@@ -127,9 +191,24 @@ func (m *Monitor) Status() Status {
 		Bytes:    m.bytes,
 		Samples:  m.samples,
 		PeakRate: round(m.rPeak),
-		BytesRem: m.tBytes - m.bytes,
-		Progress: percentOf(float64(m.bytes), float64(m.tBytes)),
+		BytesRem: m.tBytes - m.tOff - m.bytes,
+		Progress: percentOf(float64(m.tOff+m.bytes), float64(m.tBytes)),
+		Waits:    m.wCount,
+		WaitTime: m.wTime,
+		Limited:  m.lShort,
+		Denied:   m.lZero,
+		Limit:    m.lRate,
+		Latency:  m.ioEMA,
+		QuotaRem: -1,
+		Dropped:  m.dCount,
 	}
+	if m.quota != nil {
+		m.quota.mu.Lock()
+		s.QuotaRem = m.quota.remaining()
+		m.quota.mu.Unlock()
+	}
+	p := m.latencyPercentiles(0.5, 0.99)
+	s.LatencyP50, s.LatencyP99 = p[0], p[1]
 	if s.BytesRem < 0 {
 		s.BytesRem = 0
 	}
@@ -145,7 +224,7 @@ func (m *Monitor) Status() Status {
 					if ns > float64(timeRemLimit) {
 						ns = float64(timeRemLimit)
 					}
-					s.TimeRem = clockRound(time.Duration(ns))
+					s.TimeRem = clockRound(time.Duration(ns), m.res)
 				}
 			}
 		}
@@ -164,12 +243,73 @@ func (m *Monitor) Status() Status {
 // period. Thus, if the sampling rate is 100ms, the lowest achievable flow rate
 // is 10 bytes per second.
 //
+// If token bucket limiting is enabled (see WithBurst), the per-sample
+// restriction is replaced by the number of tokens in the bucket, which allows
+// an idle stream to catch up with a burst of up to the bucket size. If pacing
+// is enabled (see WithPacing), it replaces both of these restrictions.
+//
+// If adaptive rate limiting is enabled (see WithAIMD and WithScavenger), rate
+// is restricted to the current adaptive limit. If the Monitor is a member of a
+// Group, rate is further restricted to the member's fair share of the group
+// limit. In both cases, Limit is effective even if rate < 1. If the Monitor has
+// a parent Node (see WithParent), the result is further restricted by the
+// limits of all enclosing nodes. If the Monitor uses a SharedLimit (see
+// WithShared), the result is finally restricted to the bytes that are leased
+// from the shared limit, and any Backend error is returned by LimitContext.
+//
+// If the Monitor has a Quota (see WithQuota), want is reduced to the remaining
+// quota. Once the quota is used up, LimitContext returns (0, ErrQuotaExceeded)
+// without blocking, even if block == true.
+//
 // For usage examples, see the implementation of Reader and Writer in io.go.
 func (m *Monitor) Limit(want int, rate int64, block bool) (n int) {
-	if want < 1 || rate < 1 {
-		return want
+	n, _ = m.LimitContext(context.Background(), want, rate, block)
+	return
+}
+
+// LimitContext is like Limit, but it returns (0, ctx.Err()) if ctx is done
+// before any bytes may be transferred.
+func (m *Monitor) LimitContext(ctx context.Context, want int, rate int64, block bool) (n int, err error) {
+	if want < 1 {
+		return want, nil
+	}
+	if err = ctx.Err(); err != nil {
+		return 0, err
 	}
 	m.mu.Lock()
+	now := m.update(0)
+	if m.quota != nil && m.active {
+		m.quota.mu.Lock()
+		rem := m.quota.remaining()
+		m.quota.mu.Unlock()
+		if rem == 0 {
+			m.mu.Unlock()
+			return 0, ErrQuotaExceeded
+		} else if rem > 0 && rem < int64(want) {
+			want = int(rem)
+		}
+	}
+	if m.ctl != nil && m.active {
+		rate = m.ctl.limit(rate)
+	}
+	if m.group != nil {
+		rate = m.group.share(m, rate, now)
+	}
+	wTime := m.wTime
+	if m.active {
+		if m.lRate = rate; rate < 1 {
+			m.lRate = 0
+		}
+	}
+	var parent *Node
+	var shared *SharedLimit
+	if m.active {
+		parent, shared = m.parent, m.shared
+	}
+	if rate < 1 {
+		m.mu.Unlock()
+		return enclosingLimit(ctx, parent, shared, want, block)
+	}
 
 	// Determine the maximum number of bytes that can be sent in one sample
 	limit := round(float64(rate) * m.sRate.Seconds())
@@ -177,23 +317,61 @@ func (m *Monitor) Limit(want int, rate int64, block bool) (n int) {
 		limit = 1
 	}
 
-	// If block == true, wait until m.sBytes < limit
-	if now := m.update(0); block {
-		for m.sBytes >= limit && m.active {
-			now = m.waitNextSample(now)
+	if m.pSize > 0 {
+		limit, err = m.paceLimit(ctx, rate, int64(want), block)
+	} else if m.bSize > 0 {
+		limit, err = m.bucketLimit(ctx, now, rate, limit, block)
+	} else {
+		// If block == true, wait until m.sBytes < limit
+		if block {
+			for m.sBytes >= limit && m.active && err == nil {
+				now, err = m.waitNextSample(ctx, now)
+			}
 		}
+		limit -= m.sBytes
+	}
+	if m.wTime != wTime {
+		m.wCount++
+	}
+	if err != nil {
+		m.mu.Unlock()
+		return 0, err
 	}
 
 	// Make limit <= want (unlimited if the transfer is no longer active)
-	if limit -= m.sBytes; limit > int64(want) || !m.active {
+	if limit > int64(want) || !m.active {
 		limit = int64(want)
+	} else if limit < 0 {
+		limit = 0
+	}
+	if limit < int64(want) {
+		if m.lShort++; limit == 0 && !block {
+			m.lZero++
+		}
 	}
 	m.mu.Unlock()
 
-	if limit < 0 {
-		limit = 0
+	// Apply the enclosing limits without holding the lock
+	if limit > 0 {
+		return enclosingLimit(ctx, parent, shared, int(limit), block)
 	}
-	return int(limit)
+	return 0, nil
+}
+
+// enclosingLimit restricts want bytes to the limits of the parent node and the
+// shared limit, either of which may be nil. The shared limit is applied last,
+// because it consumes the leased bytes that it allows.
+func enclosingLimit(ctx context.Context, parent *Node, shared *SharedLimit, want int, block bool) (n int, err error) {
+	n = want
+	if parent != nil {
+		if n, err = parent.limitContext(ctx, n, block); err != nil || n == 0 {
+			return
+		}
+	}
+	if shared != nil {
+		n, err = shared.limitContext(ctx, n, block)
+	}
+	return
 }
 
 // SetTransferSize specifies the total size of the data transfer, which allows
@@ -207,17 +385,48 @@ func (m *Monitor) SetTransferSize(bytes int64) {
 	m.mu.Unlock()
 }
 
+// SetTransferOffset specifies the number of bytes that were transferred before
+// the Monitor was created, such as the starting position of a download that is
+// resumed with a Range request. The offset is included in the overall progress
+// and time to completion, but not in Bytes or any of the transfer rates.
+func (m *Monitor) SetTransferOffset(bytes int64) {
+	if bytes < 0 {
+		bytes = 0
+	}
+	m.mu.Lock()
+	m.tOff = bytes
+	m.mu.Unlock()
+}
+
 // update accumulates the transferred byte count for the current sample until
-// clock() - m.sLast >= m.sRate. The monitor status is updated once the current
-// sample is done.
+// m.clock() - m.sLast >= m.sRate. The monitor status is updated once the
+// current sample is done.
 func (m *Monitor) update(n int) (now time.Duration) {
 	if !m.active {
 		return
 	}
-	if now = clock(); n > 0 {
+	if now = m.clock(); n > 0 {
 		m.tLast = now
+		if m.group != nil {
+			m.group.agg.Update(n)
+		}
+		if m.parent != nil {
+			m.parent.Update(n)
+		}
+		if m.shared != nil {
+			m.shared.charge(n)
+		}
+		if m.quota != nil {
+			m.quota.consume(int64(n))
+		}
 	}
 	m.sBytes += int64(n)
+	if n > 0 && len(m.subs) > 0 {
+		m.notify()
+	}
+	if m.bSize > 0 {
+		m.bTokens -= float64(n)
+	}
 	if sTime := now - m.sLast; sTime >= m.sRate {
 		t := sTime.Seconds()
 		if m.rSample = float64(m.sBytes) / t; m.rSample > m.rPeak {
@@ -232,11 +441,20 @@ func (m *Monitor) update(n int) (now time.Duration) {
 		} else {
 			m.rEMA = m.rSample
 		}
+		if m.ctl != nil {
+			m.ctl.sample(m.rSample)
+		}
 		m.reset(now)
 	}
 	return
 }
 
+// clock returns the current time of the Monitor clock as a timestamp with the
+// Monitor clock resolution relative to the process start time.
+func (m *Monitor) clock() time.Duration {
+	return timeToClock(m.clk.Now(), m.res)
+}
+
 // reset clears the current sample state in preparation for the next sample.
 func (m *Monitor) reset(sampleTime time.Duration) {
 	m.bytes += m.sBytes
@@ -247,21 +465,41 @@ func (m *Monitor) reset(sampleTime time.Duration) {
 
 // waitNextSample sleeps for the remainder of the current sample. The lock is
 // released and reacquired during the actual sleep period, so it's possible for
-// the transfer to be inactive when this method returns.
-func (m *Monitor) waitNextSample(now time.Duration) time.Duration {
-	const minWait = 5 * time.Millisecond
+// the transfer to be inactive when this method returns. The wait is interrupted
+// if ctx is done.
+func (m *Monitor) waitNextSample(ctx context.Context, now time.Duration) (time.Duration, error) {
 	current := m.sLast
 
 	// sleep until the last sample time changes (ideally, just one iteration)
 	for m.sLast == current && m.active {
-		d := current + m.sRate - now
-		m.mu.Unlock()
-		if d < minWait {
-			d = minWait
+		var err error
+		if now, err = m.sleep(ctx, current+m.sRate-now); err != nil {
+			return now, err
 		}
-		time.Sleep(d)
-		m.mu.Lock()
-		now = m.update(0)
 	}
-	return now
+	return now, nil
+}
+
+// sleep releases the lock, sleeps for at least d, and reacquires the lock. It
+// returns the current m.clock() value, which is 0 if the transfer became
+// inactive in the meantime, and ctx.Err() if ctx was done before d elapsed.
+func (m *Monitor) sleep(ctx context.Context, d time.Duration) (time.Duration, error) {
+	minWait := m.res / 4
+	m.mu.Unlock()
+	if d < minWait {
+		d = minWait
+	}
+	var err error
+	start := m.clk.Now()
+	timer := m.clk.After(d)
+	select {
+	case <-timer:
+	case <-ctx.Done():
+		stopTimer(m.clk, timer)
+		err = ctx.Err()
+	}
+	wait := m.clk.Now().Sub(start)
+	m.mu.Lock()
+	m.wTime += wait
+	return m.update(0), err
 }
@@ -0,0 +1,127 @@
+package flowcontrol
+
+import (
+	"sync"
+	"time"
+)
+
+// Group enforces an aggregate transfer rate limit on multiple Monitors. The
+// group limit is divided among the members using weighted max-min fairness
+// (see SetWeight), which is recalculated whenever a Monitor joins or leaves the
+// group, changes its weight, or becomes idle. Members continue to maintain
+// their own statistics, while the group collects the aggregate statistics for
+// all of its members.
+type Group struct {
+	mu      sync.Mutex          // Mutex guarding access to all fields below
+	limit   int64               // Aggregate rate limit (unlimited when <= 0)
+	members map[*Monitor]*share // Active member monitors
+	dirty   bool                // Flag indicating that shares must be recalculated
+	aTime   time.Duration       // Time of the most recent share calculation
+	agg     *Monitor            // Aggregate statistics
+}
+
+// NewGroup creates a new group with an aggregate rate limit of limit bytes per
+// second. opts are passed to the constructor of the aggregate Monitor. All
+// members should use the same Clock as the aggregate Monitor.
+func NewGroup(limit int64, opts ...Option) *Group {
+	return &Group{
+		limit:   limit,
+		members: make(map[*Monitor]*share),
+		agg:     New(0, 0, opts...),
+	}
+}
+
+// WithGroup adds the new Monitor to group g.
+func WithGroup(g *Group) Option {
+	return func(m *Monitor) {
+		m.group = g
+	}
+}
+
+// Add adds an existing Monitor to the group. The Monitor is removed from its
+// previous group, if any. It leaves the group automatically when Done is
+// called. Add is a NOOP for inactive Monitors.
+func (g *Group) Add(m *Monitor) {
+	m.mu.Lock()
+	if m.active && m.group != g {
+		if m.group != nil {
+			m.group.remove(m)
+		}
+		m.group = g
+		g.add(m)
+	}
+	m.mu.Unlock()
+}
+
+// Len returns the number of active group members.
+func (g *Group) Len() int {
+	g.mu.Lock()
+	n := len(g.members)
+	g.mu.Unlock()
+	return n
+}
+
+// SetLimit changes the aggregate rate limit to new bytes per second and returns
+// the previous setting.
+func (g *Group) SetLimit(new int64) (old int64) {
+	g.mu.Lock()
+	old, g.limit = g.limit, new
+	g.dirty = true
+	g.mu.Unlock()
+	return
+}
+
+// Status returns the aggregate transfer status of all current and former group
+// members.
+func (g *Group) Status() Status {
+	return g.agg.Status()
+}
+
+// add adds m to the group. The caller must hold m.mu.
+func (g *Group) add(m *Monitor) {
+	g.mu.Lock()
+	g.members[m] = &share{weight: m.weight, last: m.sLast}
+	g.dirty = true
+	g.mu.Unlock()
+}
+
+// remove removes m from the group.
+func (g *Group) remove(m *Monitor) {
+	g.mu.Lock()
+	delete(g.members, m)
+	g.dirty = true
+	g.mu.Unlock()
+}
+
+// setWeight changes the weight of member m.
+func (g *Group) setWeight(m *Monitor, w float64) {
+	g.mu.Lock()
+	if s := g.members[m]; s != nil {
+		s.weight = w
+		g.dirty = true
+	}
+	g.mu.Unlock()
+}
+
+// share returns the rate limit of member m, which is the lower of rate and the
+// member's share of the group limit. Any value < 1 means unlimited. Calling
+// share marks m as an active member at time now.
+func (g *Group) share(m *Monitor, rate int64, now time.Duration) int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := g.members[m]
+	if g.limit <= 0 || s == nil {
+		return rate
+	}
+	if s.demand != rate || now-s.last > g.idleTime() {
+		g.dirty = true
+	}
+	s.demand, s.last = rate, now
+	if g.dirty || g.aTime != now {
+		g.schedule(now)
+	}
+	if r := round(s.rate); r > 0 {
+		return r
+	}
+	return 1
+}
@@ -0,0 +1,55 @@
+package flowcontrol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGroup(t *testing.T) {
+	b := make([]byte, 100)
+	c := NewManualClock(clockStart)
+	g := NewGroup(200, WithClock(c))
+	w1 := NewWriter(&bytes.Buffer{}, 0, WithClock(c), WithGroup(g))
+	w2 := NewWriter(&bytes.Buffer{}, 0, WithClock(c), WithGroup(g))
+	w1.SetBlocking(false)
+	w2.SetBlocking(false)
+	if n := g.Len(); n != 2 {
+		t.Fatalf("g.Len() expected 2; got %v", n)
+	}
+
+	// Each member gets half of the group limit (10 bytes per sample)
+	if n, err := w1.Write(b); n != 10 || err != ErrLimit {
+		t.Fatalf("w1.Write(b) expected 10 (ErrLimit); got %v (%v)", n, err)
+	}
+	if n, err := w2.Write(b); n != 10 || err != ErrLimit {
+		t.Fatalf("w2.Write(b) expected 10 (ErrLimit); got %v (%v)", n, err)
+	}
+
+	// Member limit is lower than its share
+	w2.SetLimit(50)
+	if n, err := w2.Write(b); n != 0 || err != ErrLimit {
+		t.Fatalf("w2.Write(b) expected 0 (ErrLimit); got %v (%v)", n, err)
+	}
+
+	// Remaining member gets the entire group limit
+	w2.Close()
+	if n := g.Len(); n != 1 {
+		t.Fatalf("g.Len() expected 1; got %v", n)
+	}
+	if n, err := w1.Write(b); n != 10 || err != ErrLimit {
+		t.Fatalf("w1.Write(b) expected 10 (ErrLimit); got %v (%v)", n, err)
+	}
+
+	// Aggregate statistics
+	c.Add(_100ms)
+	if s := g.Status(); s.Bytes != 30 {
+		t.Fatalf("g.Status().Bytes expected 30; got %v", s.Bytes)
+	}
+	if old := g.SetLimit(0); old != 200 {
+		t.Fatalf("g.SetLimit(0) expected 200; got %v", old)
+	}
+	w1.Close()
+	if n := g.Len(); n != 0 {
+		t.Fatalf("g.Len() expected 0; got %v", n)
+	}
+}
@@ -0,0 +1,259 @@
+package flowcontrol
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Handler is an http.Handler that restricts the rate of data transfer of
+// request and response bodies. Each request has its own limits, and all
+// concurrent requests from the same client share the client limits.
+//
+// The optional fields must be set before the Handler starts serving requests.
+type Handler struct {
+	h         http.Handler // Wrapped handler
+	reqLimit  int64        // Per-request body rate limit
+	respLimit int64        // Per-response body rate limit
+	opts      []Option     // Monitor options
+
+	// ClientReqLimit and ClientRespLimit are the aggregate request and response
+	// body rate limits for each client (unlimited when <= 0).
+	ClientReqLimit  int64
+	ClientRespLimit int64
+
+	// Key returns the client identifier of a request. If nil, the client IP
+	// address from r.RemoteAddr is used.
+	Key func(r *http.Request) string
+
+	// Log, if not nil, is called with the final request and response body
+	// transfer status after each request is served.
+	Log func(r *http.Request, req, resp Status)
+
+	mu      sync.Mutex             // Mutex guarding access to clients
+	clients map[string]*httpClient // Clients with active requests
+}
+
+// httpClient tracks the shared limits of a single Handler client.
+type httpClient struct {
+	in   *Group // Request body flow control
+	out  *Group // Response body flow control
+	refs int    // Number of active requests
+}
+
+// NewHandler returns a Handler that restricts the request body of each request
+// served by h to reqLimit bytes per second and the response body to respLimit
+// bytes per second. opts are passed to the constructors of all Monitors.
+func NewHandler(h http.Handler, reqLimit, respLimit int64, opts ...Option) *Handler {
+	return &Handler{
+		h:         h,
+		reqLimit:  reqLimit,
+		respLimit: respLimit,
+		opts:      opts,
+		clients:   make(map[string]*httpClient),
+	}
+}
+
+// ServeHTTP serves the request with rate-limited request and response bodies.
+// The limiters are available to the wrapped handler via RequestLimiters.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rOpts, wOpts := h.opts, h.opts
+	key, c := h.acquire(r)
+	if c != nil {
+		defer h.release(key)
+		rOpts = append(h.opts[:len(h.opts):len(h.opts)], WithGroup(c.in))
+		wOpts = append(h.opts[:len(h.opts):len(h.opts)], WithGroup(c.out))
+	}
+	ctx := r.Context()
+	req := &body{NewReader(r.Body, h.reqLimit, rOpts...), ctx}
+	resp := &responseWriter{w, NewWriter(w, h.respLimit, wOpts...), ctx}
+	r = r.WithContext(context.WithValue(ctx, httpKey{}, &httpLimiters{req.Reader, resp.w}))
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = req
+	}
+	defer func() {
+		req.Done()
+		resp.w.Done()
+		if h.Log != nil {
+			h.Log(r, req.Status(), resp.w.Status())
+		}
+	}()
+	h.h.ServeHTTP(resp, r)
+}
+
+// acquire returns the client key and state for request r. The state is nil if
+// there are no client limits.
+func (h *Handler) acquire(r *http.Request) (string, *httpClient) {
+	if h.ClientReqLimit <= 0 && h.ClientRespLimit <= 0 {
+		return "", nil
+	}
+	var key string
+	if h.Key != nil {
+		key = h.Key(r)
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		key = host
+	} else {
+		key = r.RemoteAddr
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := h.clients[key]
+	if c == nil {
+		c = &httpClient{
+			in:  NewGroup(h.ClientReqLimit, h.opts...),
+			out: NewGroup(h.ClientRespLimit, h.opts...),
+		}
+		h.clients[key] = c
+	}
+	c.refs++
+	return key, c
+}
+
+// release removes the state of client key once it has no active requests.
+func (h *Handler) release(key string) {
+	h.mu.Lock()
+	c := h.clients[key]
+	if c.refs--; c.refs == 0 {
+		delete(h.clients, key)
+	}
+	h.mu.Unlock()
+}
+
+// httpKey is the context key for httpLimiters.
+type httpKey struct{}
+
+// httpLimiters are the limiters of a request served by Handler.
+type httpLimiters struct {
+	req  *Reader
+	resp *Writer
+}
+
+// RequestLimiters returns the request body and response body limiters of r,
+// which must be a request that is being served by Handler. Both values are nil
+// if r is not such a request. The limits and blocking behavior may be changed
+// by the handler that serves r.
+func RequestLimiters(r *http.Request) (req *Reader, resp *Writer) {
+	if l, ok := r.Context().Value(httpKey{}).(*httpLimiters); ok {
+		return l.req, l.resp
+	}
+	return nil, nil
+}
+
+// responseWriter implements http.ResponseWriter with a rate-limited body.
+type responseWriter struct {
+	http.ResponseWriter
+	w   *Writer
+	ctx context.Context
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	return rw.w.WriteContext(rw.ctx, p)
+}
+
+func (rw *responseWriter) ReadFrom(r io.Reader) (int64, error) {
+	return rw.w.ReadFromContext(rw.ctx, r)
+}
+
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack takes over the connection from the original http.ResponseWriter. Data
+// written to the returned connection is not rate-limited.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := rw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// Push initiates an HTTP/2 server push if the original http.ResponseWriter
+// supports it. The pushed response is not rate-limited.
+func (rw *responseWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := rw.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Unwrap returns the original http.ResponseWriter for http.ResponseController.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// body is a rate-limited request or response body. Waiting for the rate limit
+// is interrupted when ctx is done.
+type body struct {
+	*Reader
+	ctx context.Context
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	return b.ReadContext(b.ctx, p)
+}
+
+func (b *body) WriteTo(w io.Writer) (int64, error) {
+	return b.WriteToContext(b.ctx, w)
+}
+
+// Transport is an http.RoundTripper that restricts the rate of data transfer of
+// request and response bodies. Each request has its own limits and is a member
+// of the Out and In groups, which enforce the transport-wide limits.
+type Transport struct {
+	Out *Group // Transport-wide request body flow control
+	In  *Group // Transport-wide response body flow control
+
+	rt        http.RoundTripper // Underlying transport
+	reqLimit  int64             // Per-request body rate limit
+	respLimit int64             // Per-response body rate limit
+	opts      []Option          // Monitor options
+}
+
+// NewTransport returns a Transport that restricts the request body of each
+// request sent via rt to reqLimit bytes per second and the response body to
+// respLimit bytes per second. http.DefaultTransport is used if rt is nil. The
+// transport-wide limits are initially disabled and can be changed with
+// t.Out.SetLimit and t.In.SetLimit. opts are passed to the constructors of all
+// Monitors, including the aggregate Monitors of the Out and In groups.
+func NewTransport(rt http.RoundTripper, reqLimit, respLimit int64, opts ...Option) *Transport {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &Transport{
+		Out:       NewGroup(0, opts...),
+		In:        NewGroup(0, opts...),
+		rt:        rt,
+		reqLimit:  reqLimit,
+		respLimit: respLimit,
+		opts:      opts,
+	}
+}
+
+// RoundTrip implements http.RoundTripper. The body of the returned response
+// implements Limiter, which provides the response transfer status.
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	opts := t.opts[:len(t.opts):len(t.opts)]
+	if r.Body != nil && r.Body != http.NoBody {
+		r = r.Clone(r.Context())
+		r.Body = &body{NewReader(r.Body, t.reqLimit, append(opts, WithGroup(t.Out))...), r.Context()}
+	}
+	resp, err := t.rt.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &body{NewReader(resp.Body, t.respLimit, append(opts, WithGroup(t.In))...), r.Context()}
+	return resp, nil
+}
+
+// CloseIdleConnections closes the idle connections of the underlying transport
+// if it supports this operation.
+func (t *Transport) CloseIdleConnections() {
+	if c, ok := t.rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,120 @@
+package flowcontrol
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	b := make([]byte, 100)
+	c := NewManualClock(clockStart)
+	var status [2]Status
+	h := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, resp := RequestLimiters(r)
+		if req == nil || resp == nil {
+			t.Fatalf("RequestLimiters(r) expected non-nil limiters")
+		}
+		resp.SetBlocking(false)
+		if n, err := w.Write(b); n != 10 || err != ErrLimit {
+			t.Errorf("w.Write(b) expected 10 (ErrLimit); got %v (%v)", n, err)
+		}
+		req.SetBlocking(false)
+		if n, err := r.Body.Read(b); n != 5 || err != nil {
+			t.Errorf("r.Body.Read(b) expected 5 (<nil>); got %v (%v)", n, err)
+		}
+	}), 50, 0, WithClock(c))
+	h.ClientRespLimit = 100
+	h.Log = func(r *http.Request, req, resp Status) {
+		status[0], status[1] = req, resp
+	}
+
+	// Make sure h implements http.Handler
+	_ = http.Handler(h)
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader(string(b)))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if n := w.Body.Len(); n != 10 {
+		t.Fatalf("w.Body.Len() expected 10; got %v", n)
+	}
+	if s := status[0]; s.Bytes != 5 || s.Active {
+		t.Fatalf("Log() req expected 5 inactive bytes; got %+v", s)
+	}
+	if s := status[1]; s.Bytes != 10 || s.Active {
+		t.Fatalf("Log() resp expected 10 inactive bytes; got %+v", s)
+	}
+	if n := len(h.clients); n != 0 {
+		t.Fatalf("len(h.clients) expected 0; got %v", n)
+	}
+
+	// Copies stop when the request is canceled; Hijack is forwarded
+	h = NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n, err := w.(io.ReaderFrom).ReadFrom(bytes.NewReader(b)); n != 10 || err != context.Canceled {
+			t.Errorf("w.ReadFrom(b) expected 10 (%v); got %v (%v)", context.Canceled, n, err)
+		}
+		if _, _, err := w.(http.Hijacker).Hijack(); err != http.ErrNotSupported {
+			t.Errorf("w.Hijack() expected %v; got %v", http.ErrNotSupported, err)
+		}
+	}), 0, 100, WithClock(c))
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		c.BlockUntil(1)
+		cancel()
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+}
+
+// roundTripFunc implements http.RoundTripper.
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestTransport(t *testing.T) {
+	b := make([]byte, 100)
+	c := NewManualClock(clockStart)
+	var sent int
+	tr := NewTransport(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		r.Body.(Limiter).SetBlocking(false)
+		sent, _ = r.Body.Read(make([]byte, 100))
+		r.Body.Close()
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewReader(b)),
+		}, nil
+	}), 200, 0, WithClock(c))
+	tr.In.SetLimit(100)
+
+	// Make sure tr implements http.RoundTripper
+	_ = http.RoundTripper(tr)
+
+	r, _ := http.NewRequest("POST", "http://localhost/", bytes.NewReader(b))
+	resp, err := tr.RoundTrip(r)
+	if err != nil {
+		t.Fatalf("tr.RoundTrip(r) error: %v", err)
+	}
+	if sent != 20 {
+		t.Fatalf("r.Body.Read() expected 20; got %v", sent)
+	}
+	l := resp.Body.(Limiter)
+	l.SetBlocking(false)
+	if n, err := resp.Body.Read(b); n != 10 || err != nil {
+		t.Fatalf("resp.Body.Read(b) expected 10 (<nil>); got %v (%v)", n, err)
+	}
+	if n, err := resp.Body.Read(b); n != 0 || err != nil {
+		t.Fatalf("resp.Body.Read(b) expected 0 (<nil>); got %v (%v)", n, err)
+	}
+	resp.Body.Close()
+	if s := l.Status(); s.Bytes != 10 || s.Active {
+		t.Fatalf("resp.Body.Status() expected 10 inactive bytes; got %+v", s)
+	}
+	if n := tr.In.Len(); n != 0 {
+		t.Fatalf("tr.In.Len() expected 0; got %v", n)
+	}
+}
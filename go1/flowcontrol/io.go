@@ -5,12 +5,14 @@
 package flowcontrol
 
 import (
+	"context"
 	"errors"
 	"io"
+	"sync/atomic"
 )
 
-// ErrLimit is returned by the Writer when a non-blocking write is short due to
-// the transfer rate limit.
+// ErrLimit is returned by the Writer and by Reader.WriteTo when a non-blocking
+// transfer is short due to the transfer rate limit.
 var ErrLimit = errors.New("flowcontrol: transfer rate limit exceeded")
 
 // Limiter is implemented by the Reader and Writer to provide a consistent
@@ -21,6 +23,7 @@ type Limiter interface {
 	SetTransferSize(bytes int64)
 	SetLimit(new int64) (old int64)
 	SetBlocking(new bool) (old bool)
+	SetWeight(new float64) (old float64)
 }
 
 // Reader implements io.ReadCloser with a restriction on the rate of data
@@ -29,39 +32,85 @@ type Reader struct {
 	io.Reader // Data source
 	*Monitor  // Flow control monitor
 
-	limit int64 // Rate limit in bytes per second (unlimited when <= 0)
-	block bool  // What to do when no new bytes can be read due to the limit
+	limit atomic.Int64 // Rate limit in bytes per second (unlimited when <= 0)
+	block atomic.Bool  // What to do when no new bytes can be read due to the limit
 }
 
-// NewReader restricts all Read operations on r to limit bytes per second.
-func NewReader(r io.Reader, limit int64) *Reader {
-	return &Reader{r, New(0, 0), limit, true}
+// NewReader restricts all Read operations on r to limit bytes per second. opts
+// are passed to the Monitor constructor.
+func NewReader(r io.Reader, limit int64, opts ...Option) *Reader {
+	lr := &Reader{Reader: r, Monitor: New(0, 0, opts...)}
+	lr.limit.Store(limit)
+	lr.block.Store(true)
+	return lr
 }
 
 // Read reads up to len(p) bytes into p without exceeding the current transfer
 // rate limit. It returns (0, nil) immediately if r is non-blocking and no new
-// bytes can be read at this time.
+// bytes can be read at this time, and (0, ErrQuotaExceeded) if the transfer
+// quota is used up (see WithQuota).
 func (r *Reader) Read(p []byte) (n int, err error) {
-	p = p[:r.Limit(len(p), r.limit, r.block)]
-	if len(p) > 0 {
+	return r.ReadContext(context.Background(), p)
+}
+
+// ReadContext is like Read, but it returns (0, ctx.Err()) if ctx is done while
+// waiting for the rate limit. A Read call on the underlying reader that is
+// already in progress is not interrupted.
+func (r *Reader) ReadContext(ctx context.Context, p []byte) (n int, err error) {
+	if n, err = r.LimitContext(ctx, len(p), r.limit.Load(), r.block.Load()); err != nil {
+		return 0, err
+	}
+	if p, n = p[:n], 0; len(p) > 0 {
 		n, err = r.IO(r.Reader.Read(p))
 	}
 	return
 }
 
+// WriteTo implements io.WriterTo. It copies data from the underlying reader to
+// w until EOF or an error without exceeding the current transfer rate limit. The
+// data is copied in chunks of at most one sample worth of bytes, which are
+// passed to w.ReadFrom if w implements io.ReaderFrom. This preserves any
+// optimizations, such as sendfile and splice, of the underlying types. WriteTo
+// returns (n, ErrLimit) if r is non-blocking and no additional bytes can be
+// read at this time. EOF is detected by a chunk that is shorter than the
+// allowance, so if the data ends exactly at the end of an allowance, a blocking
+// copy waits for one more allowance and a non-blocking copy may return
+// ErrLimit before the next call returns (0, nil).
+func (r *Reader) WriteTo(w io.Writer) (n int64, err error) {
+	return r.WriteToContext(context.Background(), w)
+}
+
+// WriteToContext is like WriteTo, but it returns (n, ctx.Err()) if ctx is done
+// while waiting for the rate limit.
+func (r *Reader) WriteToContext(ctx context.Context, w io.Writer) (n int64, err error) {
+	var buf []byte
+	for {
+		var c int
+		if c, err = r.LimitContext(ctx, copyMax, r.limit.Load(), r.block.Load()); err != nil {
+			return
+		} else if c == 0 {
+			return n, ErrLimit
+		}
+		var m int64
+		m, err = copyLimit(w, r.Reader, int64(c), &buf)
+		n += int64(r.Update(int(m)))
+		if err != nil || m < int64(c) {
+			return
+		}
+	}
+}
+
 // SetLimit changes the transfer rate limit to new bytes per second and returns
-// the previous setting.
+// the previous setting. It may be called concurrently with other methods.
 func (r *Reader) SetLimit(new int64) (old int64) {
-	old, r.limit = r.limit, new
-	return
+	return r.limit.Swap(new)
 }
 
 // SetBlocking changes the blocking behavior and returns the previous setting. A
 // Read call on a non-blocking reader returns immediately if no additional bytes
 // may be read at this time due to the rate limit.
 func (r *Reader) SetBlocking(new bool) (old bool) {
-	old, r.block = r.block, new
-	return
+	return r.block.Swap(new)
 }
 
 // Close closes the underlying reader if it implements the io.Closer interface.
@@ -79,26 +128,42 @@ type Writer struct {
 	io.Writer // Data destination
 	*Monitor  // Flow control monitor
 
-	limit int64 // Rate limit in bytes per second (unlimited when <= 0)
-	block bool  // What to do when no new bytes can be written due to the limit
+	limit atomic.Int64 // Rate limit in bytes per second (unlimited when <= 0)
+	block atomic.Bool  // What to do when no new bytes can be written due to the limit
 }
 
 // NewWriter restricts all Write operations on w to limit bytes per second. The
 // transfer rate and the default blocking behavior (true) can be changed
-// directly on the returned *Writer.
-func NewWriter(w io.Writer, limit int64) *Writer {
-	return &Writer{w, New(0, 0), limit, true}
+// directly on the returned *Writer. opts are passed to the Monitor constructor.
+func NewWriter(w io.Writer, limit int64, opts ...Option) *Writer {
+	lw := &Writer{Writer: w, Monitor: New(0, 0, opts...)}
+	lw.limit.Store(limit)
+	lw.block.Store(true)
+	return lw
 }
 
 // Write writes len(p) bytes from p to the underlying data stream without
 // exceeding the current transfer rate limit. It returns (n, ErrLimit) if w is
-// non-blocking and no additional bytes can be written at this time.
+// non-blocking and no additional bytes can be written at this time, and
+// (n, ErrQuotaExceeded) if the transfer quota is used up (see WithQuota).
 func (w *Writer) Write(p []byte) (n int, err error) {
+	return w.WriteContext(context.Background(), p)
+}
+
+// WriteContext is like Write, but it returns (n, ctx.Err()) if ctx is done
+// while waiting for the rate limit, where n is the number of bytes written
+// before that happened. A Write call on the underlying writer that is already
+// in progress is not interrupted.
+func (w *Writer) WriteContext(ctx context.Context, p []byte) (n int, err error) {
 	var c int
 	for len(p) > 0 && err == nil {
-		s := p[:w.Limit(len(p), w.limit, w.block)]
-		if len(s) > 0 {
-			c, err = w.IO(w.Writer.Write(s))
+		if c, err = w.LimitContext(ctx, len(p), w.limit.Load(), w.block.Load()); err != nil {
+			break
+		}
+		if s := p[:c]; len(s) > 0 {
+			start := w.clk.Now()
+			c, err = w.Writer.Write(s)
+			c, err = w.ioDone(c, err, start)
 		} else {
 			return n, ErrLimit
 		}
@@ -108,19 +173,66 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 	return
 }
 
+// ReadFrom implements io.ReaderFrom. It copies data from r to the underlying
+// writer until EOF or an error without exceeding the current transfer rate
+// limit. The data is copied in the same way as by Reader.WriteTo. ReadFrom
+// returns (n, ErrLimit) if w is non-blocking and no additional bytes can be
+// written at this time. The latency of each Write call on the underlying writer
+// is recorded as by Write, unless the underlying writer implements
+// io.ReaderFrom, whose calls include the time spent reading r.
+func (w *Writer) ReadFrom(r io.Reader) (n int64, err error) {
+	return w.ReadFromContext(context.Background(), r)
+}
+
+// ReadFromContext is like ReadFrom, but it returns (n, ctx.Err()) if ctx is
+// done while waiting for the rate limit.
+func (w *Writer) ReadFromContext(ctx context.Context, r io.Reader) (n int64, err error) {
+	var buf []byte
+	var dst io.Writer = w.Writer
+	if _, ok := dst.(io.ReaderFrom); !ok {
+		dst = timedWriter{w}
+	}
+	for {
+		var c int
+		if c, err = w.LimitContext(ctx, copyMax, w.limit.Load(), w.block.Load()); err != nil {
+			return
+		} else if c == 0 {
+			return n, ErrLimit
+		}
+		var m int64
+		m, err = copyLimit(dst, r, int64(c), &buf)
+		n += int64(w.Update(int(m)))
+		if err != nil || m < int64(c) {
+			return
+		}
+	}
+}
+
+// timedWriter records the latency of each Write call on the underlying writer
+// of a Writer.
+type timedWriter struct{ w *Writer }
+
+func (t timedWriter) Write(p []byte) (int, error) {
+	start := t.w.clk.Now()
+	n, err := t.w.Writer.Write(p)
+	d := t.w.clk.Now().Sub(start)
+	t.w.mu.Lock()
+	t.w.ioLatency(err, d)
+	t.w.mu.Unlock()
+	return n, err
+}
+
 // SetLimit changes the transfer rate limit to new bytes per second and returns
-// the previous setting.
+// the previous setting. It may be called concurrently with other methods.
 func (w *Writer) SetLimit(new int64) (old int64) {
-	old, w.limit = w.limit, new
-	return
+	return w.limit.Swap(new)
 }
 
 // SetBlocking changes the blocking behavior and returns the previous setting. A
 // Write call on a non-blocking writer returns as soon as no additional bytes
 // may be written at this time due to the rate limit.
 func (w *Writer) SetBlocking(new bool) (old bool) {
-	old, w.block = w.block, new
-	return
+	return w.block.Swap(new)
 }
 
 // Close closes the underlying writer if it implements the io.Closer interface.
@@ -131,3 +243,29 @@ func (w *Writer) Close() error {
 	}
 	return nil
 }
+
+// copyMax is the maximum number of bytes that are copied by Reader.WriteTo and
+// Writer.ReadFrom between Monitor updates.
+const copyMax = 1 << 20
+
+// copyBufMax is the maximum size of the copy buffer.
+const copyBufMax = 32 * 1024
+
+// copyLimit copies up to n bytes from src to dst. If dst does not implement
+// io.ReaderFrom, *buf is used as the copy buffer. It is grown to hold n bytes,
+// up to copyBufMax, so that its size follows the current rate limit. A return
+// value less than n with a nil error means that src has reached EOF.
+func copyLimit(dst io.Writer, src io.Reader, n int64, buf *[]byte) (int64, error) {
+	lr := &io.LimitedReader{R: src, N: n}
+	if _, ok := dst.(io.ReaderFrom); ok {
+		return io.Copy(dst, lr)
+	}
+	size := n
+	if size > copyBufMax {
+		size = copyBufMax
+	}
+	if int64(len(*buf)) < size {
+		*buf = make([]byte, size)
+	}
+	return io.CopyBuffer(dst, lr, *buf)
+}
@@ -6,6 +6,8 @@ package flowcontrol
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"reflect"
 	"testing"
 	"time"
@@ -20,15 +22,36 @@ const (
 	_500ms = 500 * time.Millisecond
 )
 
-func nextStatus(m *Monitor) Status {
-	samples := m.samples
-	for i := 0; i < 30; i++ {
-		if s := m.Status(); s.Samples != samples {
-			return s
+// clockStart is the initial time of all ManualClocks used in tests.
+var clockStart = time.Unix(1e9, 0)
+
+// advance waits for at least one timer to be pending on c and then advances the
+// clock by d.
+func advance(c *ManualClock, d time.Duration) {
+	c.BlockUntil(1)
+	c.Add(d)
+}
+
+// rearm calls fn, which interrupts a wait on c, and blocks until the waiting
+// goroutine creates a new timer.
+func rearm(c *ManualClock, fn func()) {
+	c.mu.Lock()
+	old := make(map[chan time.Time]bool)
+	for _, mt := range c.timers {
+		old[mt.c] = true
+	}
+	c.mu.Unlock()
+	fn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		for _, mt := range c.timers {
+			if !old[mt.c] {
+				return
+			}
 		}
-		time.Sleep(5 * time.Millisecond)
+		c.cond.Wait()
 	}
-	return m.Status()
 }
 
 func TestReader(t *testing.T) {
@@ -37,8 +60,8 @@ func TestReader(t *testing.T) {
 		in[i] = byte(i)
 	}
 	b := make([]byte, 100)
-	r := NewReader(bytes.NewReader(in), 100)
-	start := time.Now()
+	c := NewManualClock(clockStart)
+	r := NewReader(bytes.NewReader(in), 100, WithClock(c))
 
 	// Make sure r implements Limiter
 	_ = Limiter(r)
@@ -46,48 +69,60 @@ func TestReader(t *testing.T) {
 	// 1st read of 10 bytes is performed immediately
 	if n, err := r.Read(b); n != 10 || err != nil {
 		t.Fatalf("r.Read(b) expected 10 (<nil>); got %v (%v)", n, err)
-	} else if rt := time.Since(start); rt > _50ms {
-		t.Fatalf("r.Read(b) took too long (%v)", rt)
 	}
 
 	// No new Reads allowed in the current sample
 	r.SetBlocking(false)
 	if n, err := r.Read(b); n != 0 || err != nil {
 		t.Fatalf("r.Read(b) expected 0 (<nil>); got %v (%v)", n, err)
-	} else if rt := time.Since(start); rt > _50ms {
-		t.Fatalf("r.Read(b) took too long (%v)", rt)
 	}
 
 	status := [6]Status{0: r.Status()} // No samples in the first status
 
 	// 2nd read of 10 bytes blocks until the next sample
 	r.SetBlocking(true)
-	if n, err := r.Read(b[10:]); n != 10 || err != nil {
-		t.Fatalf("r.Read(b[10:]) expected 10 (<nil>); got %v (%v)", n, err)
-	} else if rt := time.Since(start); rt < _100ms {
-		t.Fatalf("r.Read(b[10:]) returned ahead of time (%v)", rt)
+	done := make(chan int)
+	go func() {
+		n, err := r.Read(b[10:])
+		if err != nil {
+			n = -1
+		}
+		done <- n
+	}()
+	advance(c, _50ms)
+	select {
+	case n := <-done:
+		t.Fatalf("r.Read(b[10:]) returned ahead of time (%v)", n)
+	default:
+	}
+	advance(c, _50ms)
+	if n := <-done; n != 10 {
+		t.Fatalf("r.Read(b[10:]) expected 10 (<nil>); got %v", n)
 	}
 
-	status[1] = r.Status()            // 1st sample
-	status[2] = nextStatus(r.Monitor) // 2nd sample
-	status[3] = nextStatus(r.Monitor) // No activity for the 3rd sample
+	status[1] = r.Status() // 1st sample
+	c.Add(_100ms)
+	status[2] = r.Status() // 2nd sample
+	c.Add(_100ms)
+	status[3] = r.Status() // No activity for the 3rd sample
 
 	if n := r.Done(); n != 20 {
 		t.Fatalf("r.Done() expected 20; got %v", n)
 	}
 
 	status[4] = r.Status()
-	status[5] = nextStatus(r.Monitor) // Timeout
-	start = status[0].Start
+	c.Add(_100ms)
+	status[5] = r.Status() // Timeout
+	start := clockStart
 
-	// Active, Start, Duration, Idle, Bytes, Samples, InstRate, CurRate, AvgRate, PeakRate, BytesRem, TimeRem, Progress
+	// Active, Start, Duration, Idle, Bytes, Samples, InstRate, CurRate, AvgRate, PeakRate, BytesRem, TimeRem, Progress, Waits, WaitTime, Limited, Denied, Limit, Latency, LatencyP50, LatencyP99, QuotaRem, Dropped
 	want := []Status{
-		Status{true, start, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-		Status{true, start, _100ms, 0, 10, 1, 100, 100, 100, 100, 0, 0, 0},
-		Status{true, start, _200ms, _100ms, 20, 2, 100, 100, 100, 100, 0, 0, 0},
-		Status{true, start, _300ms, _200ms, 20, 3, 0, 90, 67, 100, 0, 0, 0},
-		Status{false, start, _300ms, 0, 20, 3, 0, 0, 67, 100, 0, 0, 0},
-		Status{false, start, _300ms, 0, 20, 3, 0, 0, 67, 100, 0, 0, 0},
+		Status{true, start, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 1, 100, 0, 0, 0, -1, 0},
+		Status{true, start, _100ms, 0, 10, 1, 100, 100, 100, 100, 0, 0, 0, 1, _100ms, 3, 1, 100, 0, 0, 0, -1, 0},
+		Status{true, start, _200ms, _100ms, 20, 2, 100, 100, 100, 100, 0, 0, 0, 1, _100ms, 3, 1, 100, 0, 0, 0, -1, 0},
+		Status{true, start, _300ms, _200ms, 20, 3, 0, 90, 67, 100, 0, 0, 0, 1, _100ms, 3, 1, 100, 0, 0, 0, -1, 0},
+		Status{false, start, _300ms, 0, 20, 3, 0, 0, 67, 100, 0, 0, 0, 1, _100ms, 3, 1, 100, 0, 0, 0, -1, 0},
+		Status{false, start, _300ms, 0, 20, 3, 0, 0, 67, 100, 0, 0, 0, 1, _100ms, 3, 1, 100, 0, 0, 0, -1, 0},
 	}
 	for i, s := range status {
 		if !reflect.DeepEqual(&s, &want[i]) {
@@ -97,6 +132,10 @@ func TestReader(t *testing.T) {
 	if !bytes.Equal(b[:20], in[:20]) {
 		t.Errorf("r.Read() input doesn't match output")
 	}
+
+	// SetBlocking may be called concurrently with Read
+	go r.SetBlocking(false)
+	r.Read(b)
 }
 
 func TestWriter(t *testing.T) {
@@ -104,8 +143,8 @@ func TestWriter(t *testing.T) {
 	for i := range b {
 		b[i] = byte(i)
 	}
-	w := NewWriter(&bytes.Buffer{}, 200)
-	start := time.Now()
+	c := NewManualClock(clockStart)
+	w := NewWriter(&bytes.Buffer{}, 200, WithClock(c))
 
 	// Make sure w implements Limiter
 	_ = Limiter(w)
@@ -114,26 +153,41 @@ func TestWriter(t *testing.T) {
 	w.SetBlocking(false)
 	if n, err := w.Write(b); n != 20 || err != ErrLimit {
 		t.Fatalf("w.Write(b) expected 20 (ErrLimit); got %v (%v)", n, err)
-	} else if rt := time.Since(start); rt > _50ms {
-		t.Fatalf("w.Write(b) took too long (%v)", rt)
 	}
 
 	// Blocking 80-byte write
 	w.SetBlocking(true)
-	if n, err := w.Write(b[20:]); n != 80 || err != nil {
-		t.Fatalf("w.Write(b[20:]) expected 80 (<nil>); got %v (%v)", n, err)
-	} else if rt := time.Since(start); rt < _400ms {
-		t.Fatalf("w.Write(b[20:]) returned ahead of time (%v)", rt)
+	done := make(chan int)
+	go func() {
+		n, err := w.Write(b[20:])
+		if err != nil {
+			n = -1
+		}
+		done <- n
+	}()
+	for i := 0; i < 3; i++ {
+		advance(c, _100ms)
+	}
+	select {
+	case n := <-done:
+		t.Fatalf("w.Write(b[20:]) returned ahead of time (%v)", n)
+	default:
+	}
+	advance(c, _100ms)
+	if n := <-done; n != 80 {
+		t.Fatalf("w.Write(b[20:]) expected 80 (<nil>); got %v", n)
 	}
 
 	w.SetTransferSize(100)
-	status := []Status{w.Status(), nextStatus(w.Monitor)}
-	start = status[0].Start
+	status := []Status{w.Status()}
+	c.Add(_100ms)
+	status = append(status, w.Status())
+	start := clockStart
 
-	// Active, Start, Duration, Idle, Bytes, Samples, InstRate, CurRate, AvgRate, PeakRate, BytesRem, TimeRem, Progress
+	// Active, Start, Duration, Idle, Bytes, Samples, InstRate, CurRate, AvgRate, PeakRate, BytesRem, TimeRem, Progress, Waits, WaitTime, Limited, Denied, Limit, Latency, LatencyP50, LatencyP99, QuotaRem, Dropped
 	want := []Status{
-		Status{true, start, _400ms, 0, 80, 4, 200, 200, 200, 200, 20, _100ms, 80000},
-		Status{true, start, _500ms, _100ms, 100, 5, 200, 200, 200, 200, 0, 0, 100000},
+		Status{true, start, _400ms, 0, 80, 4, 200, 200, 200, 200, 20, _100ms, 80000, 4, _400ms, 5, 1, 200, 0, 0, 0, -1, 0},
+		Status{true, start, _500ms, _100ms, 100, 5, 200, 200, 200, 200, 0, 0, 100000, 4, _400ms, 5, 1, 200, 0, 0, 0, -1, 0},
 	}
 	for i, s := range status {
 		if !reflect.DeepEqual(&s, &want[i]) {
@@ -144,3 +198,118 @@ func TestWriter(t *testing.T) {
 		t.Errorf("w.Write() input doesn't match output")
 	}
 }
+
+// writerOnly hides all methods of an io.Writer other than Write.
+type writerOnly struct{ io.Writer }
+
+func TestCopy(t *testing.T) {
+	in := make([]byte, 100)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	c := NewManualClock(clockStart)
+	r := NewReader(bytes.NewReader(in), 100, WithClock(c))
+	var out bytes.Buffer
+
+	// Make sure r implements io.WriterTo
+	_ = io.WriterTo(r)
+
+	// Non-blocking copy is limited to one sample
+	r.SetBlocking(false)
+	if n, err := io.Copy(writerOnly{&out}, r); n != 10 || err != ErrLimit {
+		t.Fatalf("io.Copy(out, r) expected 10 (ErrLimit); got %v (%v)", n, err)
+	}
+
+	// Blocking copy continues until EOF
+	r.SetBlocking(true)
+	done := make(chan int64)
+	go func() {
+		n, err := io.Copy(writerOnly{&out}, r)
+		if err != nil {
+			n = -1
+		}
+		done <- n
+	}()
+	for i := 0; i < 10; i++ {
+		advance(c, _100ms)
+	}
+	if n := <-done; n != 90 {
+		t.Fatalf("io.Copy(out, r) expected 90 (<nil>); got %v", n)
+	}
+	if !bytes.Equal(in, out.Bytes()) {
+		t.Fatalf("io.Copy(out, r) input doesn't match output")
+	}
+	if n := r.Done(); n != 100 {
+		t.Fatalf("r.Done() expected 100; got %v", n)
+	}
+
+	// Make sure w implements io.ReaderFrom
+	w := NewWriter(&bytes.Buffer{}, 200, WithClock(c))
+	_ = io.ReaderFrom(w)
+
+	// Underlying bytes.Buffer.ReadFrom is used for each chunk
+	w.SetBlocking(false)
+	if n, err := io.Copy(w, bytes.NewReader(in)); n != 20 || err != ErrLimit {
+		t.Fatalf("io.Copy(w, in) expected 20 (ErrLimit); got %v (%v)", n, err)
+	}
+	c.Add(_100ms)
+	if n, err := io.Copy(w, bytes.NewReader(in[20:30])); n != 10 || err != nil {
+		t.Fatalf("io.Copy(w, in[20:30]) expected 10 (<nil>); got %v (%v)", n, err)
+	}
+
+	// EOF is detected by a chunk that is shorter than the allowance
+	c.Add(_100ms)
+	if n, err := w.ReadFrom(bytes.NewReader(in[30:45])); n != 15 || err != nil {
+		t.Fatalf("w.ReadFrom(in[30:45]) expected 15 (<nil>); got %v (%v)", n, err)
+	}
+	c.Add(_100ms)
+	if n, err := w.ReadFrom(bytes.NewReader(in[45:65])); n != 20 || err != ErrLimit {
+		t.Fatalf("w.ReadFrom(in[45:65]) expected 20 (ErrLimit); got %v (%v)", n, err)
+	}
+	c.Add(_100ms)
+	if n, err := w.ReadFrom(bytes.NewReader(nil)); n != 0 || err != nil {
+		t.Fatalf("w.ReadFrom(nil) expected 0 (<nil>); got %v (%v)", n, err)
+	}
+	if !bytes.Equal(in[:65], w.Writer.(*bytes.Buffer).Bytes()) {
+		t.Fatalf("io.Copy(w, in) input doesn't match output")
+	}
+	if n := w.Done(); n != 65 {
+		t.Fatalf("w.Done() expected 65; got %v", n)
+	}
+}
+
+func TestContext(t *testing.T) {
+	b := make([]byte, 100)
+	c := NewManualClock(clockStart)
+	r := NewReader(bytes.NewReader(b), 100, WithClock(c))
+	w := NewWriter(&bytes.Buffer{}, 100, WithClock(c))
+
+	// Blocking read is interrupted by the context deadline
+	ctx, cancel := context.WithTimeout(context.Background(), _50ms)
+	defer cancel()
+	if n, err := r.ReadContext(ctx, b); n != 10 || err != nil {
+		t.Fatalf("r.ReadContext(b) expected 10 (<nil>); got %v (%v)", n, err)
+	}
+	if n, err := r.ReadContext(ctx, b); n != 0 || err != context.DeadlineExceeded {
+		t.Fatalf("r.ReadContext(b) expected 0 (%v); got %v (%v)",
+			context.DeadlineExceeded, n, err)
+	}
+
+	// Blocking write returns the number of bytes written before cancellation
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		advance(c, _100ms)
+		c.BlockUntil(1)
+		cancel()
+	}()
+	if n, err := w.WriteContext(ctx, b); n != 20 || err != context.Canceled {
+		t.Fatalf("w.WriteContext(b) expected 20 (%v); got %v (%v)",
+			context.Canceled, n, err)
+	}
+	if n, err := w.WriteContext(ctx, b); n != 0 || err != context.Canceled {
+		t.Fatalf("w.WriteContext(b) expected 0 (%v); got %v (%v)",
+			context.Canceled, n, err)
+	}
+	r.Close()
+	w.Close()
+}
@@ -0,0 +1,149 @@
+package flowcontrol
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// latHist is the number of recent I/O call latencies that are used to calculate
+// the latency percentiles.
+const latHist = 128
+
+// ioDone is like IO, but it also records the latency of an I/O call that
+// started at time start and provides feedback to the adaptive limiter. The
+// latency is measured before m.mu is acquired, so that it does not include lock
+// contention.
+func (m *Monitor) ioDone(n int, err error, start time.Time) (int, error) {
+	d := m.clk.Now().Sub(start)
+	m.mu.Lock()
+	m.update(n)
+	m.ioLatency(err, d)
+	m.mu.Unlock()
+	return n, err
+}
+
+// ioLatency records latency d of an I/O call and provides feedback to the
+// adaptive limiter. m.mu must be held.
+func (m *Monitor) ioLatency(err error, d time.Duration) {
+	if m.active {
+		m.addLatency(d)
+		if m.ctl != nil {
+			m.ctl.feedback(err, d)
+		}
+	}
+}
+
+// addLatency records the latency of a single I/O call.
+func (m *Monitor) addLatency(d time.Duration) {
+	if m.ioHist == nil {
+		m.ioHist = make([]time.Duration, latHist)
+		m.ioEMA = d
+	} else {
+		m.ioEMA += (d - m.ioEMA) / 8
+	}
+	m.ioHist[m.ioCalls%latHist] = d
+	m.ioCalls++
+	m.ioSort = m.ioSort[:0]
+}
+
+// latencyPercentiles returns the latency percentiles p of recent I/O calls. The
+// sorted latencies are reused until the next call is recorded.
+func (m *Monitor) latencyPercentiles(p ...float64) []time.Duration {
+	out := make([]time.Duration, len(p))
+	n := len(m.ioHist)
+	if m.ioCalls < int64(n) {
+		n = int(m.ioCalls)
+	}
+	if n == 0 {
+		return out
+	}
+	if len(m.ioSort) == 0 {
+		m.ioSort = append(m.ioSort, m.ioHist[:n]...)
+		sort.Slice(m.ioSort, func(i, j int) bool { return m.ioSort[i] < m.ioSort[j] })
+	}
+	for i := range p {
+		out[i] = m.ioSort[int(math.Ceil(p[i]*float64(n)))-1]
+	}
+	return out
+}
+
+// Scavenger configures low-priority adaptive rate limiting, similar to the
+// LEDBAT congestion control algorithm used for background transfers. The
+// queuing delay is estimated as the difference between the average latency of
+// the writes to the underlying writer of a Writer during each sample and the
+// lowest latency observed so far. At the end of each sample, the adaptive limit
+// is changed by up to Increase in proportion to how far the queuing delay is
+// below or above Target, so the transfer yields to other traffic as soon as it
+// starts to build queues. The limit is halved if a write returns an error.
+type Scavenger struct {
+	Target   time.Duration // Target queuing delay (100ms if <= 0)
+	Min      int64         // Minimum rate limit (1 if <= 0)
+	Max      int64         // Maximum rate limit (unlimited if <= 0)
+	Initial  int64         // Initial rate limit (Min if <= 0)
+	Increase int64         // Maximum change per sample in bytes per second
+}
+
+// scavenger is the LEDBAT-style adaptive rate limiting state of a Monitor.
+type scavenger struct {
+	Scavenger
+	rate float64       // Current adaptive limit
+	base time.Duration // Lowest observed latency (base delay)
+	sum  time.Duration // Sum of latencies in the current sample
+	n    int           // Number of latencies in the current sample
+	lost bool          // Flag indicating an error in the current sample
+}
+
+// WithScavenger enables LEDBAT-style adaptive rate limiting with the given
+// configuration. The adaptive limit never exceeds the rate passed to Limit,
+// but it is effective even if rate < 1. The current adaptive limit is reported
+// by Status.Limit.
+func WithScavenger(cfg Scavenger) Option {
+	adaptiveBounds(&cfg.Min, &cfg.Max, &cfg.Initial)
+	if cfg.Target <= 0 {
+		cfg.Target = 100 * time.Millisecond
+	}
+	return func(m *Monitor) {
+		m.ctl = &scavenger{Scavenger: cfg, rate: float64(cfg.Initial), base: -1}
+	}
+}
+
+func (s *scavenger) limit(rate int64) int64 {
+	return adaptiveLimit(s.rate, rate)
+}
+
+func (s *scavenger) sample(rSample float64) {
+	if s.n > 0 && !s.lost {
+		queue := s.sum/time.Duration(s.n) - s.base
+		off := float64(s.Target-queue) / float64(s.Target)
+		if off < -1 {
+			off = -1
+		}
+		if off < 0 || rSample >= adaptiveTrack*s.rate {
+			s.rate += off * float64(s.Increase)
+		}
+		if s.rate < float64(s.Min) {
+			s.rate = float64(s.Min)
+		} else if s.Max > 0 && s.rate > float64(s.Max) {
+			s.rate = float64(s.Max)
+		}
+	}
+	s.sum, s.n, s.lost = 0, 0, false
+}
+
+func (s *scavenger) feedback(err error, d time.Duration) {
+	if congestion(err) {
+		if !s.lost {
+			if s.rate /= 2; s.rate < float64(s.Min) {
+				s.rate = float64(s.Min)
+			}
+			s.lost = true
+		}
+		return
+	}
+	if s.base < 0 || d < s.base {
+		s.base = d
+	}
+	s.sum += d
+	s.n++
+}
@@ -0,0 +1,98 @@
+package flowcontrol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLatency(t *testing.T) {
+	b := make([]byte, 100)
+	c := NewManualClock(clockStart)
+	sw := &slowWriter{c: c}
+	w := NewWriter(sw, 0, WithClock(c))
+	for _, d := range []time.Duration{20, 20, 40, 100} {
+		sw.delay = d * time.Millisecond
+		w.Write(b)
+	}
+	s := w.Status()
+	if want := 32187500 * time.Nanosecond; s.Latency != want {
+		t.Errorf("w.Status().Latency expected %v; got %v", want, s.Latency)
+	}
+	if want := 20 * time.Millisecond; s.LatencyP50 != want {
+		t.Errorf("w.Status().LatencyP50 expected %v; got %v", want, s.LatencyP50)
+	}
+	if want := 100 * time.Millisecond; s.LatencyP99 != want {
+		t.Errorf("w.Status().LatencyP99 expected %v; got %v", want, s.LatencyP99)
+	}
+
+	// Cached percentiles are recalculated after the next call
+	if p := w.latencyPercentiles(0.99); p[0] != 100*time.Millisecond {
+		t.Errorf("w.latencyPercentiles(0.99) expected 100ms; got %v", p[0])
+	}
+	sw.delay = 200 * time.Millisecond
+	w.Write(b)
+	if s := w.Status(); s.LatencyP99 != sw.delay {
+		t.Errorf("w.Status().LatencyP99 expected %v; got %v", sw.delay, s.LatencyP99)
+	}
+
+	// ReadFrom excludes the time spent reading the source
+	w = NewWriter(writerOnly{sw}, 0, WithClock(c))
+	sw.delay = 10 * time.Millisecond
+	w.ReadFrom(&slowReader{bytes.NewReader(b), c, 50 * time.Millisecond})
+	if s := w.Status(); s.Latency != sw.delay || s.LatencyP99 != sw.delay {
+		t.Errorf("w.Status().Latency expected %v; got %v (p99 %v)", sw.delay, s.Latency, s.LatencyP99)
+	}
+}
+
+// slowReader advances the clock by delay on each Read.
+type slowReader struct {
+	io.Reader
+	c     *ManualClock
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	r.c.Add(r.delay)
+	return r.Reader.Read(p)
+}
+
+func TestScavenger(t *testing.T) {
+	const ms = time.Millisecond
+	var m Monitor
+	WithScavenger(Scavenger{Min: 50, Max: 300, Initial: 100, Increase: 100})(&m)
+	s := m.ctl.(*scavenger)
+	tests := []struct {
+		err     error
+		latency []time.Duration
+		rSample float64
+		want    int64
+	}{
+		// No queuing delay, limit increases while the rate tracks it
+		{nil, []time.Duration{20 * ms, 30 * ms}, 100, 195},
+		{nil, []time.Duration{20 * ms}, 195, 295},
+		{nil, []time.Duration{20 * ms}, 295, 300},
+
+		// Limit does not increase if the rate is lower, or if the queuing delay
+		// is above the target
+		{nil, []time.Duration{20 * ms}, 100, 300},
+		{nil, nil, 300, 300},
+		{nil, []time.Duration{120 * ms, 220 * ms}, 300, 250},
+		{nil, []time.Duration{420 * ms}, 250, 150},
+
+		// Errors halve the limit once per sample
+		{errors.New("lost"), []time.Duration{20 * ms, 20 * ms}, 150, 75},
+		{errors.New("lost"), []time.Duration{20 * ms}, 75, 50},
+	}
+	for i, test := range tests {
+		for _, d := range test.latency {
+			s.feedback(test.err, d)
+		}
+		s.sample(test.rSample)
+		if limit := s.limit(0); limit != test.want {
+			t.Errorf("s.limit(%v) expected %v; got %v", i, test.want, limit)
+		}
+	}
+}
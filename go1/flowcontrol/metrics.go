@@ -0,0 +1,180 @@
+package flowcontrol
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// StatusSource is implemented by Monitor, Group, and all Limiters.
+type StatusSource interface {
+	Status() Status
+}
+
+// metric describes a single exported Status field.
+type metric struct {
+	name  string                // Metric name without the namespace
+	typ   string                // Prometheus metric type
+	help  string                // Metric description
+	value func(*Status) float64 // Metric value extractor
+}
+
+// metrics are the Status fields exported by Registry.
+var metrics = []metric{
+	{"active", "gauge", "Whether the transfer is active.",
+		func(s *Status) float64 {
+			if s.Active {
+				return 1
+			}
+			return 0
+		}},
+	{"bytes_total", "counter", "Total number of bytes transferred.",
+		func(s *Status) float64 { return float64(s.Bytes) }},
+	{"inst_rate_bytes", "gauge", "Instantaneous transfer rate in bytes per second.",
+		func(s *Status) float64 { return float64(s.InstRate) }},
+	{"cur_rate_bytes", "gauge", "Current transfer rate in bytes per second.",
+		func(s *Status) float64 { return float64(s.CurRate) }},
+	{"avg_rate_bytes", "gauge", "Average transfer rate in bytes per second.",
+		func(s *Status) float64 { return float64(s.AvgRate) }},
+	{"peak_rate_bytes", "gauge", "Peak instantaneous transfer rate in bytes per second.",
+		func(s *Status) float64 { return float64(s.PeakRate) }},
+	{"idle_seconds", "gauge", "Time since the last transfer of at least 1 byte.",
+		func(s *Status) float64 { return s.Idle.Seconds() }},
+	{"progress_ratio", "gauge", "Overall transfer progress between 0 and 1.",
+		func(s *Status) float64 { return s.Progress.Float() / 100 }},
+	{"limit_waits_total", "counter", "Number of Limit calls that waited for the rate limit.",
+		func(s *Status) float64 { return float64(s.Waits) }},
+	{"limit_wait_seconds_total", "counter", "Total time spent waiting for the rate limit.",
+		func(s *Status) float64 { return s.WaitTime.Seconds() }},
+	{"limit_throttled_total", "counter", "Number of Limit calls that returned less than requested.",
+		func(s *Status) float64 { return float64(s.Limited) }},
+	{"limit_denied_total", "counter", "Number of non-blocking Limit calls that returned 0.",
+		func(s *Status) float64 { return float64(s.Denied) }},
+	{"limit_bytes", "gauge", "Effective rate limit in bytes per second (0 if unlimited).",
+		func(s *Status) float64 { return float64(s.Limit) }},
+	{"io_latency_seconds", "gauge", "Exponential moving average of the I/O call latency.",
+		func(s *Status) float64 { return s.Latency.Seconds() }},
+	{"io_latency_p50_seconds", "gauge", "Median latency of recent I/O calls.",
+		func(s *Status) float64 { return s.LatencyP50.Seconds() }},
+	{"io_latency_p99_seconds", "gauge", "99th percentile latency of recent I/O calls.",
+		func(s *Status) float64 { return s.LatencyP99.Seconds() }},
+	{"quota_remaining_bytes", "gauge", "Remaining transfer quota in bytes (-1 if unlimited).",
+		func(s *Status) float64 { return float64(s.QuotaRem) }},
+	{"packets_dropped_total", "counter", "Number of datagrams dropped by policing.",
+		func(s *Status) float64 { return float64(s.Dropped) }},
+}
+
+// Registry tracks named Monitors, Groups, and Limiters and exports their status
+// as an expvar.Var and in the Prometheus text exposition format. Each metric
+// name is prefixed with the namespace and each sample has a "name" label with
+// the registered name of its source.
+type Registry struct {
+	ns      string                  // Metric namespace
+	mu      sync.Mutex              // Mutex guarding access to sources
+	sources map[string]StatusSource // Registered status sources
+}
+
+// NewRegistry returns a new empty Registry. The namespace "flowcontrol" is used
+// if ns is empty.
+func NewRegistry(ns string) *Registry {
+	if ns == "" {
+		ns = "flowcontrol"
+	}
+	return &Registry{ns: ns, sources: make(map[string]StatusSource)}
+}
+
+// Register adds src to the registry under the given name, replacing any
+// previous source with the same name.
+func (r *Registry) Register(name string, src StatusSource) {
+	r.mu.Lock()
+	r.sources[name] = src
+	r.mu.Unlock()
+}
+
+// Unregister removes the source with the given name from the registry.
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	delete(r.sources, name)
+	r.mu.Unlock()
+}
+
+// Status returns the current status of all registered sources.
+func (r *Registry) Status() map[string]Status {
+	r.mu.Lock()
+	srcs := make(map[string]StatusSource, len(r.sources))
+	for name, src := range r.sources {
+		srcs[name] = src
+	}
+	r.mu.Unlock()
+	all := make(map[string]Status, len(srcs))
+	for name, src := range srcs {
+		all[name] = src.Status()
+	}
+	return all
+}
+
+// Publish publishes the registry as an expvar variable with the given name. As
+// with expvar.Publish, it panics if the name is already in use.
+func (r *Registry) Publish(name string) {
+	expvar.Publish(name, r)
+}
+
+// String implements expvar.Var. It returns a JSON object that maps the names of
+// all registered sources to objects containing their metrics.
+func (r *Registry) String() string {
+	all := r.Status()
+	vars := make(map[string]map[string]float64, len(all))
+	for name, s := range all {
+		v := make(map[string]float64, len(metrics))
+		for _, m := range metrics {
+			v[m.name] = m.value(&s)
+		}
+		vars[name] = v
+	}
+	b, _ := json.Marshal(vars)
+	return string(b)
+}
+
+// WritePrometheus writes the status of all registered sources to w in the
+// Prometheus text exposition format.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	all := r.Status()
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	labels := make([]string, len(names))
+	for i, name := range names {
+		labels[i] = `{name="` + labelEscaper.Replace(name) + `"} `
+	}
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		name := r.ns + "_" + m.name
+		bw.WriteString("# HELP " + name + " " + m.help + "\n")
+		bw.WriteString("# TYPE " + name + " " + m.typ + "\n")
+		for i, src := range names {
+			s := all[src]
+			bw.WriteString(name + labels[i])
+			bw.WriteString(strconv.FormatFloat(m.value(&s), 'g', -1, 64))
+			bw.WriteByte('\n')
+		}
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves the status of all registered sources in the Prometheus text
+// exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WritePrometheus(w)
+}
+
+// labelEscaper escapes Prometheus label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,57 @@
+package flowcontrol
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	b := make([]byte, 100)
+	c := NewManualClock(clockStart)
+	w := NewWriter(&bytes.Buffer{}, 100, WithClock(c))
+	reg := NewRegistry("")
+	reg.Register(`w"1`, w)
+	reg.Register("w2", NewWriter(&bytes.Buffer{}, 0, WithClock(c)))
+	reg.Unregister("w2")
+
+	done := make(chan int)
+	go func() {
+		n, _ := w.Write(b[:20])
+		done <- n
+	}()
+	advance(c, _100ms)
+	<-done
+	c.Add(_100ms)
+
+	var out bytes.Buffer
+	if err := reg.WritePrometheus(&out); err != nil {
+		t.Fatalf("reg.WritePrometheus() error: %v", err)
+	}
+	for _, line := range []string{
+		"# TYPE flowcontrol_bytes_total counter",
+		`flowcontrol_bytes_total{name="w\"1"} 20`,
+		`flowcontrol_cur_rate_bytes{name="w\"1"} 100`,
+		`flowcontrol_limit_waits_total{name="w\"1"} 1`,
+		`flowcontrol_limit_wait_seconds_total{name="w\"1"} 0.1`,
+		`flowcontrol_limit_throttled_total{name="w\"1"} 1`,
+		`flowcontrol_limit_bytes{name="w\"1"} 100`,
+		`flowcontrol_quota_remaining_bytes{name="w\"1"} -1`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("reg.WritePrometheus() missing %q", line)
+		}
+	}
+	if strings.Contains(out.String(), "w2") {
+		t.Errorf("reg.WritePrometheus() contains unregistered source")
+	}
+
+	var vars map[string]map[string]float64
+	if err := json.Unmarshal([]byte(reg.String()), &vars); err != nil {
+		t.Fatalf("reg.String() is not valid JSON: %v", err)
+	}
+	if v := vars[`w"1`]["bytes_total"]; v != 20 {
+		t.Fatalf("reg.String() bytes_total expected 20; got %v", v)
+	}
+}
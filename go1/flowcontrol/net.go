@@ -0,0 +1,193 @@
+package flowcontrol
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Conn implements net.Conn with independent restrictions on the rate of
+// inbound and outbound data transfer. Read and write deadlines apply to the
+// time spent waiting for the rate limit as well as to the underlying
+// connection.
+type Conn struct {
+	net.Conn         // Underlying connection
+	In       *Reader // Inbound flow control
+	Out      *Writer // Outbound flow control
+
+	rd deadline // Read deadline
+	wd deadline // Write deadline
+}
+
+// NewConn restricts all Read operations on c to rLimit bytes per second and all
+// Write operations to wLimit bytes per second. opts are passed to the
+// constructors of both Monitors.
+func NewConn(c net.Conn, rLimit, wLimit int64, opts ...Option) *Conn {
+	return &Conn{
+		Conn: c,
+		In:   NewReader(c, rLimit, opts...),
+		Out:  NewWriter(c, wLimit, opts...),
+	}
+}
+
+// Read reads up to len(p) bytes into p without exceeding the inbound transfer
+// rate limit.
+func (c *Conn) Read(p []byte) (n int, err error) {
+	for {
+		if n, err = c.In.ReadContext(c.rd.context(), p); err != context.Canceled {
+			return n, deadlineErr(err)
+		}
+		// Deadline was changed while waiting for the rate limit
+	}
+}
+
+// Write writes len(p) bytes from p without exceeding the outbound transfer rate
+// limit.
+func (c *Conn) Write(p []byte) (n int, err error) {
+	for {
+		var m int
+		m, err = c.Out.WriteContext(c.wd.context(), p)
+		if p, n = p[m:], n+m; err != context.Canceled {
+			return n, deadlineErr(err)
+		}
+	}
+}
+
+// Close closes the underlying connection and marks both transfers as finished.
+func (c *Conn) Close() error {
+	defer c.Out.Done()
+	defer c.In.Done()
+	return c.Conn.Close()
+}
+
+// SetDeadline sets the read and write deadlines of the connection.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.rd.set(t)
+	c.wd.set(t)
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the connection.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.rd.set(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the connection.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.wd.set(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Listener implements net.Listener that restricts the rate of data transfer on
+// all accepted connections. Each connection has its own inbound and outbound
+// limits and is a member of the In and Out groups, which enforce the
+// listener-wide limits.
+type Listener struct {
+	net.Listener        // Underlying listener
+	In           *Group // Listener-wide inbound flow control
+	Out          *Group // Listener-wide outbound flow control
+
+	mu     sync.Mutex // Mutex guarding access to the per-connection limits
+	rLimit int64      // Per-connection inbound rate limit
+	wLimit int64      // Per-connection outbound rate limit
+	opts   []Option   // Monitor options for accepted connections
+}
+
+// NewListener returns a Listener that restricts each accepted connection to
+// rLimit inbound and wLimit outbound bytes per second. The listener-wide limits
+// are initially disabled and can be changed with l.In.SetLimit and
+// l.Out.SetLimit. opts are passed to the constructors of all Monitors,
+// including the aggregate Monitors of the In and Out groups.
+func NewListener(l net.Listener, rLimit, wLimit int64, opts ...Option) *Listener {
+	return &Listener{
+		Listener: l,
+		In:       NewGroup(0, opts...),
+		Out:      NewGroup(0, opts...),
+		rLimit:   rLimit,
+		wLimit:   wLimit,
+		opts:     opts,
+	}
+}
+
+// Accept waits for and returns the next connection, which is always a *Conn.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	rLimit, wLimit := l.rLimit, l.wLimit
+	l.mu.Unlock()
+	opts := l.opts[:len(l.opts):len(l.opts)]
+	return &Conn{
+		Conn: c,
+		In:   NewReader(c, rLimit, append(opts, WithGroup(l.In))...),
+		Out:  NewWriter(c, wLimit, append(opts, WithGroup(l.Out))...),
+	}, nil
+}
+
+// SetConnLimit changes the per-connection rate limits for all connections that
+// are accepted in the future. Existing connections are not affected.
+func (l *Listener) SetConnLimit(rLimit, wLimit int64) {
+	l.mu.Lock()
+	l.rLimit, l.wLimit = rLimit, wLimit
+	l.mu.Unlock()
+}
+
+// deadline converts a net.Conn deadline into a context for LimitContext.
+type deadline struct {
+	mu     sync.Mutex
+	t      time.Time          // Current deadline (none if zero)
+	ctx    context.Context    // Context for the current deadline (nil if not created)
+	cancel context.CancelFunc // Function to cancel ctx when the deadline changes
+}
+
+// set changes the deadline to t. Calls that are waiting for the rate limit are
+// interrupted with context.Canceled, at which point they should obtain a new
+// context.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	if d.cancel != nil {
+		d.cancel()
+	}
+	d.t, d.ctx, d.cancel = t, nil, nil
+	d.mu.Unlock()
+}
+
+// interrupt wakes up all calls that are waiting for the rate limit without
+// changing the deadline.
+func (d *deadline) interrupt() {
+	d.mu.Lock()
+	if d.cancel != nil {
+		d.cancel()
+	}
+	d.ctx, d.cancel = nil, nil
+	d.mu.Unlock()
+}
+
+// context returns a context that expires at the current deadline and is
+// canceled when the deadline is changed.
+func (d *deadline) context() context.Context {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ctx == nil {
+		if d.t.IsZero() {
+			d.ctx, d.cancel = context.WithCancel(context.Background())
+		} else {
+			d.ctx, d.cancel = context.WithDeadline(context.Background(), d.t)
+		}
+	}
+	return d.ctx
+}
+
+// deadlineErr converts context.DeadlineExceeded into the error that is returned
+// by net.Conn methods when a deadline is exceeded.
+func deadlineErr(err error) error {
+	if err == context.DeadlineExceeded {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package flowcontrol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConn(t *testing.T) {
+	b := make([]byte, 100)
+	c := NewManualClock(clockStart)
+	p1, p2 := net.Pipe()
+	conn := NewConn(p1, 100, 200, WithClock(c))
+	defer conn.Close()
+
+	// Make sure conn implements net.Conn
+	_ = net.Conn(conn)
+
+	go p2.Write(make([]byte, 100))
+	if n, err := conn.Read(b); n != 10 || err != nil {
+		t.Fatalf("conn.Read(b) expected 10 (<nil>); got %v (%v)", n, err)
+	}
+	go io.Copy(io.Discard, p2)
+	if n, err := conn.Write(b[:20]); n != 20 || err != nil {
+		t.Fatalf("conn.Write(b[:20]) expected 20 (<nil>); got %v (%v)", n, err)
+	}
+	if s := conn.In.Status(); s.Bytes != 0 || !s.Active {
+		t.Fatalf("conn.In.Status() expected 0 active bytes; got %+v", s)
+	}
+
+	// Deadline change wakes up a waiting call, which continues to wait
+	done := make(chan int)
+	go func() {
+		n, _ := conn.Write(b[20:50])
+		done <- n
+	}()
+	c.BlockUntil(1)
+	rearm(c, func() { conn.SetWriteDeadline(time.Now().Add(time.Hour)) })
+	c.Add(_100ms)
+	advance(c, _100ms)
+	if n := <-done; n != 30 {
+		t.Fatalf("conn.Write(b[20:50]) expected 30; got %v", n)
+	}
+
+	// Deadline interrupts a call that is waiting for the rate limit
+	conn.SetWriteDeadline(time.Now().Add(_50ms))
+	if n, err := conn.Write(b[50:]); n != 10 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("conn.Write(b[50:]) expected 10 (%v); got %v (%v)",
+			os.ErrDeadlineExceeded, n, err)
+	}
+
+	conn.Close()
+	if s := conn.Out.Status(); s.Bytes != 60 || s.Active {
+		t.Fatalf("conn.Out.Status() expected 60 inactive bytes; got %+v", s)
+	}
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	l := NewListener(ln, 0, 1000)
+	defer l.Close()
+	go func() {
+		if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			io.Copy(io.Discard, c)
+			c.Close()
+		}
+	}()
+	nc, err := l.Accept()
+	if err != nil {
+		t.Fatalf("l.Accept() error: %v", err)
+	}
+	c, ok := nc.(*Conn)
+	if !ok {
+		t.Fatalf("l.Accept() expected *Conn; got %T", nc)
+	}
+	if n := l.Out.Len(); n != 1 {
+		t.Fatalf("l.Out.Len() expected 1; got %v", n)
+	}
+
+	// Listener-wide limit is lower than the per-connection limit
+	l.Out.SetLimit(100)
+	c.Out.SetBlocking(false)
+	if n, err := c.Write(make([]byte, 100)); n != 10 || err != ErrLimit {
+		t.Fatalf("c.Write() expected 10 (ErrLimit); got %v (%v)", n, err)
+	}
+
+	c.Close()
+	if n := l.Out.Len(); n != 0 {
+		t.Fatalf("l.Out.Len() expected 0; got %v", n)
+	}
+	if _, err := c.Write(bytes.Repeat([]byte{0}, 10)); err == nil {
+		t.Fatalf("c.Write() on a closed connection expected an error")
+	}
+}
@@ -0,0 +1,69 @@
+package flowcontrol
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// OpLimiter restricts the rate of discrete operations, such as requests or
+// packets, instead of bytes. The embedded Monitor counts operations, so all
+// Status fields that refer to bytes report the number of operations and all
+// rates are in operations per second.
+//
+// Token bucket limiting (see WithBurst) is always enabled with a default bucket
+// size of 1, which allows limits below one operation per sample. A larger burst
+// may be specified with opts or changed by SetBurst. As with Reader and Writer,
+// concurrent calls may exceed the limit by a small amount, because admission
+// and accounting are separate steps.
+type OpLimiter struct {
+	*Monitor // Flow control monitor
+
+	limit atomic.Int64 // Rate limit in operations per second (unlimited when <= 0)
+}
+
+// NewOpLimiter restricts operations to limit per second. opts are passed to the
+// Monitor constructor.
+func NewOpLimiter(limit int64, opts ...Option) *OpLimiter {
+	l := &OpLimiter{Monitor: New(0, 0, opts...)}
+	if l.bSize <= 0 {
+		l.setBurst(1)
+	}
+	l.limit.Store(limit)
+	return l
+}
+
+// Acquire blocks until n operations may be performed without exceeding the
+// rate limit and records them. The operations may be admitted over multiple
+// samples if n is greater than the burst size. If ctx is done before all
+// operations are admitted, it returns ctx.Err() and the operations that were
+// already admitted remain recorded.
+func (l *OpLimiter) Acquire(ctx context.Context, n int) error {
+	for n > 0 {
+		c, err := l.LimitContext(ctx, n, l.limit.Load(), true)
+		if err != nil {
+			return err
+		}
+		n -= l.Update(c)
+	}
+	return nil
+}
+
+// TryAcquire records n operations and returns true if they may be performed
+// immediately without exceeding the rate limit. Otherwise, it returns false
+// and no operations are recorded.
+func (l *OpLimiter) TryAcquire(n int) bool {
+	if n < 1 {
+		return true
+	}
+	if l.Limit(n, l.limit.Load(), false) < n {
+		return false
+	}
+	l.Update(n)
+	return true
+}
+
+// SetLimit changes the rate limit to new operations per second and returns the
+// previous setting.
+func (l *OpLimiter) SetLimit(new int64) (old int64) {
+	return l.limit.Swap(new)
+}
@@ -0,0 +1,64 @@
+package flowcontrol
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestOpLimiter(t *testing.T) {
+	c := NewManualClock(clockStart)
+	l := NewOpLimiter(5, WithClock(c))
+
+	// One operation every 200ms
+	if !l.TryAcquire(1) {
+		t.Fatalf("l.TryAcquire(1) expected true")
+	}
+	if l.TryAcquire(1) {
+		t.Fatalf("l.TryAcquire(1) expected false")
+	}
+	c.Add(_100ms)
+	if l.TryAcquire(1) {
+		t.Fatalf("l.TryAcquire(1) expected false after 100ms")
+	}
+	c.Add(_100ms)
+	if !l.TryAcquire(1) {
+		t.Fatalf("l.TryAcquire(1) expected true after 200ms")
+	}
+
+	// Burst allows multiple operations after a period of inactivity
+	l.SetBurst(3)
+	c.Add(time.Second)
+	if l.TryAcquire(4) {
+		t.Fatalf("l.TryAcquire(4) expected false")
+	}
+	if !l.TryAcquire(3) {
+		t.Fatalf("l.TryAcquire(3) expected true")
+	}
+
+	// Acquire waits for the bucket to refill
+	done := make(chan error)
+	go func() {
+		done <- l.Acquire(context.Background(), 2)
+	}()
+	advance(c, _200ms)
+	advance(c, _200ms)
+	if err := <-done; err != nil {
+		t.Fatalf("l.Acquire(2) error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.Acquire(ctx, 1); err != context.Canceled {
+		t.Fatalf("l.Acquire(1) expected %v; got %v", context.Canceled, err)
+	}
+
+	c.Add(_100ms)
+	if s := l.Status(); s.Bytes != 7 {
+		t.Fatalf("l.Status().Bytes expected 7; got %v", s.Bytes)
+	}
+
+	// A burst specified by opts starts with a full bucket
+	if l := NewOpLimiter(5, WithClock(c), WithBurst(10)); !l.TryAcquire(10) {
+		t.Fatalf("l.TryAcquire(10) expected true with WithBurst(10)")
+	}
+}
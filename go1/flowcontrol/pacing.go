@@ -0,0 +1,54 @@
+package flowcontrol
+
+import (
+	"context"
+	"time"
+)
+
+// WithPacing spreads transfers evenly over time instead of allowing up to one
+// sample worth of bytes at the start of each sample. Each Limit call returns
+// at most size bytes, and consecutive allowances are separated by the time it
+// takes to transfer the previous one at the current rate, so a 10 Gbit/s
+// stream with a 64 KiB quantum is sent with gaps of about 52µs. If a wait takes
+// longer than necessary by less than the clock resolution, the difference is
+// made up by later calls. Longer delays are treated as idle time, which is not
+// carried over. Use WithResolution to allow waits shorter than 5ms.
+func WithPacing(size int64) Option {
+	return func(m *Monitor) {
+		m.pSize = size
+	}
+}
+
+// SetPacing changes the pacing quantum to new bytes and returns the previous
+// setting. Pacing is disabled if new <= 0.
+func (m *Monitor) SetPacing(new int64) (old int64) {
+	m.mu.Lock()
+	old, m.pSize = m.pSize, new
+	m.mu.Unlock()
+	return
+}
+
+// paceLimit returns the number of bytes (0 <= n <= min(want, m.pSize)) that may
+// be transferred immediately at rate bytes per second. If block == true, the
+// call waits until the next allowance is available or ctx is done.
+func (m *Monitor) paceLimit(ctx context.Context, rate, want int64, block bool) (int64, error) {
+	now := m.clk.Now()
+	for wait := m.pNext.Sub(now); wait > 0; wait = m.pNext.Sub(now) {
+		if !block || !m.active {
+			return 0, nil
+		}
+		if _, err := m.sleep(ctx, wait); err != nil {
+			return 0, err
+		}
+		now = m.clk.Now()
+	}
+	if m.pNext.Before(now.Add(-m.res)) {
+		m.pNext = now // Idle
+	}
+	n := m.pSize
+	if n > want {
+		n = want
+	}
+	m.pNext = m.pNext.Add(time.Duration(float64(n) / float64(rate) * 1e9))
+	return n, nil
+}
@@ -0,0 +1,75 @@
+package flowcontrol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolution(t *testing.T) {
+	c := NewManualClock(clockStart)
+	m := New(5*time.Millisecond, time.Second, WithClock(c), WithResolution(time.Millisecond))
+	m.Update(10)
+	c.Add(3 * time.Millisecond)
+	if s := m.Status(); s.Idle != 3*time.Millisecond || s.Samples != 0 {
+		t.Fatalf("m.Status() expected 3ms idle and 0 samples; got %v", s)
+	}
+	c.Add(2 * time.Millisecond)
+	if s := m.Status(); s.Samples != 1 || s.InstRate != 2000 {
+		t.Fatalf("m.Status() expected 1 sample at 2000 B/s; got %v", s)
+	}
+
+	// The default resolution rounds the sampling rate to 20ms
+	if m := New(5*time.Millisecond, 0); m.sRate != 5*clockRate {
+		t.Fatalf("New(5ms) expected a %v sampling rate; got %v", 5*clockRate, m.sRate)
+	}
+}
+
+func TestPacing(t *testing.T) {
+	const us = time.Microsecond
+	c := NewManualClock(clockStart)
+	m := New(0, 0, WithClock(c), WithResolution(100*us), WithPacing(1000))
+
+	// 1000 bytes every 100µs at 10 MB/s
+	if n := m.Limit(5000, 10e6, false); n != 1000 {
+		t.Fatalf("m.Limit(5000) expected 1000; got %v", n)
+	}
+	if n := m.Limit(5000, 10e6, false); n != 0 {
+		t.Fatalf("m.Limit(5000) expected 0; got %v", n)
+	}
+	c.Add(60 * us)
+	if n := m.Limit(500, 10e6, false); n != 0 {
+		t.Fatalf("m.Limit(500) expected 0 after 60µs; got %v", n)
+	}
+	c.Add(40 * us)
+	if n := m.Limit(500, 10e6, false); n != 500 {
+		t.Fatalf("m.Limit(500) expected 500 after 100µs; got %v", n)
+	}
+
+	// Blocking call waits for the next allowance (50µs)
+	done := make(chan int)
+	go func() { done <- m.Limit(5000, 10e6, true) }()
+	c.BlockUntil(1)
+	c.Add(50 * us)
+	if n := <-done; n != 1000 {
+		t.Fatalf("m.Limit(5000, true) expected 1000; got %v", n)
+	}
+	if s := m.Status(); s.Waits != 1 || s.WaitTime != 50*us {
+		t.Fatalf("m.Status() expected 1 wait (50µs); got %v", s)
+	}
+
+	// Small delays are made up, but idle time is not carried over
+	c.Add(150 * us) // 50µs late
+	if n := m.Limit(5000, 10e6, false); n != 1000 {
+		t.Fatalf("m.Limit(5000) expected 1000 after a delay; got %v", n)
+	}
+	c.Add(50 * us)
+	if n := m.Limit(5000, 10e6, false); n != 1000 {
+		t.Fatalf("m.Limit(5000) expected 1000 after 50µs; got %v", n)
+	}
+	c.Add(time.Second)
+	for i, want := range []int{1000, 0} {
+		if n := m.Limit(5000, 10e6, false); n != want {
+			t.Fatalf("m.Limit(5000) #%v expected %v after idle; got %v", i, want, n)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package flowcontrol
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// maxDatagram is the default token bucket size of Packets, which allows any
+// UDP datagram to be admitted in policing mode.
+const maxDatagram = 64 << 10
+
+// PacketConn implements net.PacketConn with independent restrictions on the
+// rate of inbound and outbound datagrams. Datagrams are never split. Read and
+// write deadlines apply to the time spent waiting for the rate limit as well as
+// to the underlying connection.
+type PacketConn struct {
+	net.PacketConn          // Underlying connection
+	In             *Packets // Inbound flow control
+	Out            *Packets // Outbound flow control
+
+	rd deadline // Read deadline
+	wd deadline // Write deadline
+}
+
+// NewPacketConn restricts all ReadFrom operations on c to rLimit bytes per
+// second and all WriteTo operations to wLimit bytes per second. opts are passed
+// to NewPackets.
+func NewPacketConn(c net.PacketConn, rLimit, wLimit int64, opts ...Option) *PacketConn {
+	return &PacketConn{
+		PacketConn: c,
+		In:         NewPackets(rLimit, opts...),
+		Out:        NewPackets(wLimit, opts...),
+	}
+}
+
+// ReadFrom reads the next datagram that is admitted by the inbound limits. In
+// policing mode, datagrams that exceed the limits are read and discarded.
+func (c *PacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		block := c.In.block.Load()
+		if block {
+			if err = c.In.wait(c.rd.context(), 1); err == context.Canceled {
+				continue // Deadline was changed while waiting for the rate limit
+			} else if err != nil {
+				return 0, nil, deadlineErr(err)
+			}
+		}
+		if n, addr, err = c.PacketConn.ReadFrom(p); err != nil || block || c.In.police(n) {
+			c.In.Update(n)
+			return
+		}
+	}
+}
+
+// WriteTo writes a datagram once it is admitted by the outbound limits. In
+// policing mode, a datagram that exceeds the limits is dropped and reported as
+// written, as it would be by a lossy network.
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if c.Out.block.Load() {
+		for {
+			if err = c.Out.wait(c.wd.context(), len(p)); err != context.Canceled {
+				break
+			}
+		}
+		if err != nil {
+			return 0, deadlineErr(err)
+		}
+	} else if !c.Out.police(len(p)) {
+		return len(p), nil
+	}
+	n, err = c.PacketConn.WriteTo(p, addr)
+	c.Out.Update(n)
+	return
+}
+
+// Close closes the underlying connection and marks both transfers as finished.
+func (c *PacketConn) Close() error {
+	defer c.Out.Done()
+	defer c.In.Done()
+	return c.PacketConn.Close()
+}
+
+// SetDeadline sets the read and write deadlines of the connection.
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	c.rd.set(t)
+	c.wd.set(t)
+	return c.PacketConn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the connection.
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.rd.set(t)
+	return c.PacketConn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the connection.
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	c.wd.set(t)
+	return c.PacketConn.SetWriteDeadline(t)
+}
+
+// Packets restricts one direction of a PacketConn to a byte budget and an
+// optional packet budget. In the default blocking mode, each datagram waits
+// until both budgets allow at least one more byte and packet to be
+// transferred, and the entire datagram is charged against the byte budget once
+// it has been transferred. This preserves the average rate without splitting
+// datagrams. In policing mode (SetBlocking(false)), datagrams that exceed
+// either budget are dropped instead, which is reported by Status.Dropped.
+//
+// Token bucket limiting (see WithBurst) is always enabled with a default bucket
+// size of 64 KiB, so that a datagram of any size can be admitted in policing
+// mode. A different burst may be specified with opts or changed by SetBurst.
+type Packets struct {
+	*Monitor            // Flow control monitor
+	Ops      *OpLimiter // Packet rate restriction (unlimited by default)
+
+	limit atomic.Int64 // Rate limit in bytes per second (unlimited when <= 0)
+	block atomic.Bool  // What to do when a datagram exceeds the limits
+}
+
+// NewPackets restricts datagrams to limit bytes per second. opts are passed to
+// the Monitor constructor and apply to the byte budget only. The Ops limiter
+// uses the same clock and resolution, but its other settings, such as the
+// burst size, must be changed on p.Ops directly.
+func NewPackets(limit int64, opts ...Option) *Packets {
+	m := New(0, 0, opts...)
+	if m.bSize <= 0 {
+		m.setBurst(maxDatagram)
+	}
+	p := &Packets{
+		Monitor: m,
+		Ops:     NewOpLimiter(0, WithClock(m.clk), WithResolution(m.res)),
+	}
+	p.limit.Store(limit)
+	p.block.Store(true)
+	return p
+}
+
+// SetLimit changes the byte rate limit to new bytes per second and returns the
+// previous setting. The packet rate limit is changed by p.Ops.SetLimit.
+func (p *Packets) SetLimit(new int64) (old int64) {
+	return p.limit.Swap(new)
+}
+
+// SetBlocking changes the blocking behavior and returns the previous setting.
+// Datagrams that exceed the limits of a non-blocking Packets are dropped.
+func (p *Packets) SetBlocking(new bool) (old bool) {
+	return p.block.Swap(new)
+}
+
+// Done marks both transfers as finished and returns the total number of bytes
+// transferred.
+func (p *Packets) Done() int64 {
+	p.Ops.Done()
+	return p.Monitor.Done()
+}
+
+// wait blocks until a datagram of n bytes may be transferred or ctx is done.
+func (p *Packets) wait(ctx context.Context, n int) error {
+	if _, err := p.LimitContext(ctx, n, p.limit.Load(), true); err != nil {
+		return err
+	}
+	return p.Ops.Acquire(ctx, 1)
+}
+
+// police returns true if a datagram of n bytes may be transferred immediately.
+// Otherwise, the datagram is recorded as dropped.
+func (p *Packets) police(n int) bool {
+	if p.Limit(n, p.limit.Load(), false) >= n && p.Ops.TryAcquire(1) {
+		return true
+	}
+	p.mu.Lock()
+	p.dCount++
+	p.mu.Unlock()
+	return false
+}
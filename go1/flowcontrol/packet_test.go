@@ -0,0 +1,104 @@
+package flowcontrol
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// packetQueue is an in-memory net.PacketConn that returns written datagrams
+// from ReadFrom.
+type packetQueue struct {
+	net.PacketConn
+	c chan []byte
+}
+
+func (q *packetQueue) ReadFrom(p []byte) (int, net.Addr, error) {
+	return copy(p, <-q.c), nil, nil
+}
+
+func (q *packetQueue) WriteTo(p []byte, _ net.Addr) (int, error) {
+	q.c <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (q *packetQueue) Close() error { return nil }
+
+func TestPacketConn(t *testing.T) {
+	c := NewManualClock(clockStart)
+	q := &packetQueue{c: make(chan []byte, 10)}
+	pc := NewPacketConn(q, 1000, 1000, WithClock(c), WithBurst(1500))
+	b := make([]byte, 2000)
+
+	// Byte options do not apply to the packet budget
+	if n := pc.Out.Ops.SetBurst(1); n != 1 {
+		t.Fatalf("pc.Out.Ops burst expected 1; got %v", n)
+	}
+
+	// Policing drops datagrams that exceed the byte budget
+	pc.Out.SetBlocking(false)
+	for i, n := range []int{1000, 1000, 200} {
+		if m, err := pc.WriteTo(b[:n], nil); m != n || err != nil {
+			t.Fatalf("pc.WriteTo(%v) #%v expected %v (<nil>); got %v (%v)", n, i, n, m, err)
+		}
+	}
+	if s := pc.Out.Status(); s.Dropped != 1 || len(q.c) != 2 {
+		t.Fatalf("pc.Out expected 1 dropped and 2 sent datagrams; got %v and %v", s.Dropped, len(q.c))
+	}
+
+	// ... and inbound datagrams that exceed it are discarded
+	q.c <- make([]byte, 1000)
+	q.c <- make([]byte, 300)
+	pc.In.SetBlocking(false)
+	for i, want := range []int{1000, 200, 300} {
+		if n, _, err := pc.ReadFrom(b); n != want || err != nil {
+			t.Fatalf("pc.ReadFrom() #%v expected %v (<nil>); got %v (%v)", i, want, n, err)
+		}
+	}
+	if s := pc.In.Status(); s.Dropped != 1 {
+		t.Fatalf("pc.In expected 1 dropped datagram; got %v", s.Dropped)
+	}
+
+	// Blocking mode waits instead and never splits datagrams
+	pc.Out.SetBlocking(true)
+	done := make(chan int)
+	go func() {
+		n, _ := pc.WriteTo(b, nil) // 2000 bytes with 300 tokens in the bucket
+		m, _ := pc.WriteTo(b[:10], nil)
+		done <- n + m
+	}()
+	if d := <-q.c; len(d) != 2000 {
+		t.Fatalf("pc.WriteTo(b) expected a 2000-byte datagram; got %v", len(d))
+	}
+	c.BlockUntil(1)
+	c.Add(time.Second) // 300 - 2000 + 1000 tokens
+	c.BlockUntil(1)
+	select {
+	case n := <-done:
+		t.Fatalf("pc.WriteTo(b[:10]) returned ahead of time (%v)", n)
+	default:
+	}
+	c.Add(time.Second)
+	if n := <-done; n != 2010 {
+		t.Fatalf("pc.WriteTo() expected 2010 bytes; got %v", n)
+	}
+	if s := pc.Out.Status(); s.Dropped != 1 || s.WaitTime != 2*time.Second {
+		t.Fatalf("pc.Out.Status() expected 1 dropped datagram and 2s wait time; got %v", s)
+	}
+	pc.Close()
+
+	// Packet budget
+	q = &packetQueue{c: make(chan []byte, 10)}
+	pc = NewPacketConn(q, 0, 0, WithClock(c))
+	pc.Out.SetBlocking(false)
+	pc.Out.Ops.SetLimit(10)
+	for i := 0; i < 2; i++ {
+		if n, _ := pc.WriteTo(b[:1], nil); n != 1 || len(q.c) != 1 {
+			t.Fatalf("pc.WriteTo(1) #%v expected 1 queued datagram; got %v", i, len(q.c))
+		}
+	}
+	if s := pc.Out.Status(); s.Dropped != 1 {
+		t.Fatalf("pc.Out expected 1 dropped datagram; got %v", s.Dropped)
+	}
+	pc.Close()
+}
@@ -0,0 +1,336 @@
+package flowcontrol
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMTU = 1500                   // Default maximum segment size of a Link
+	defaultRTO = 200 * time.Millisecond // Default retransmission delay of a Link
+)
+
+// Link describes the conditions of one direction of a simulated network link.
+// The zero value is a link without any restrictions or delays.
+type Link struct {
+	Rate      int64         // Bandwidth in bytes per second (unlimited if <= 0)
+	Latency   time.Duration // One-way delay
+	Jitter    time.Duration // Maximum random deviation from Latency
+	MTU       int           // Maximum segment size (1500 bytes if <= 0)
+	Loss      float64       // Probability that a segment is lost and retransmitted
+	RTO       time.Duration // Additional delay of lost segments (200ms if <= 0)
+	Stall     float64       // Probability of a stall before each segment
+	StallTime time.Duration // Duration of each stall
+	Seed      int64         // Random number generator seed (random if 0)
+}
+
+// mtu returns the maximum segment size of l.
+func (l *Link) mtu() int {
+	if l.MTU > 0 {
+		return l.MTU
+	}
+	return defaultMTU
+}
+
+// PipeConn is one end of a Pipe. Unlike net.Pipe, writes do not wait for the
+// peer to read the data. Each write is split into segments of at most MTU
+// bytes, which are paced at the link rate (see WithPacing) and become readable
+// by the peer after a delay of Latency plus a uniformly distributed random
+// value in [-Jitter, Jitter]. Segments are never delivered out of order, so a
+// delayed segment also delays the ones that follow it, as in a TCP stream. A
+// lost segment is delivered RTO later than it otherwise would be. A stall
+// suspends the transmission for StallTime before the next segment is sent.
+// Data in flight is buffered without limit.
+//
+// In and Out report the status of the inbound and outbound directions. The
+// inbound Monitor of one end is the outbound Monitor of the other.
+type PipeConn struct {
+	In  *Monitor // Inbound flow control (the Out Monitor of the peer)
+	Out *Monitor // Outbound flow control
+
+	peer *PipeConn  // Other end of the pipe
+	rx   pipeQueue  // Inbound segments in flight
+	wmu  sync.Mutex // Mutex serializing writes
+	lmu  sync.Mutex // Mutex guarding link and rng
+	link Link       // Outbound link conditions
+	rng  *rand.Rand // Random number generator for the outbound link
+
+	rd   deadline      // Read deadline
+	wd   deadline      // Write deadline
+	done chan struct{} // Channel closed by Close
+	once sync.Once     // Guard for closing done
+}
+
+// pipeQueue is a queue of segments in flight to one end of a Pipe.
+type pipeQueue struct {
+	mu   sync.Mutex
+	segs []pipeSegment // Segments in order of delivery
+	last time.Time     // Delivery time of the most recent segment
+	eof  bool          // Flag indicating that the sender closed the pipe
+	wake chan struct{} // Signal for new segments and EOF
+}
+
+// pipeSegment is a segment in flight.
+type pipeSegment struct {
+	b  []byte    // Unread data
+	at time.Time // Delivery time
+}
+
+// Pipe creates an in-memory, full-duplex network connection with the
+// conditions of a real network link, which allows slow or unreliable links to
+// be reproduced in tests. Data written to c1 is read from c2 according to ab,
+// and data written to c2 is read from c1 according to ba. opts are passed to
+// the constructors of both Monitors. All delays are measured by the Monitor
+// clock, so a ManualClock (see WithClock) simulates the link without any real
+// delays. Deadlines, as with Conn, use real time.
+func Pipe(ab, ba Link, opts ...Option) (c1, c2 *PipeConn) {
+	c1, c2 = newPipeConn(ab, opts), newPipeConn(ba, opts)
+	c1.peer, c1.In = c2, c2.Out
+	c2.peer, c2.In = c1, c1.Out
+	return
+}
+
+// newPipeConn creates one end of a Pipe.
+func newPipeConn(l Link, opts []Option) *PipeConn {
+	seed := l.Seed
+	if seed == 0 {
+		seed = rand.Int63()
+	}
+	opts = append([]Option{WithPacing(int64(l.mtu()))}, opts...)
+	return &PipeConn{
+		Out:  New(0, 0, opts...),
+		rx:   pipeQueue{wake: make(chan struct{}, 1)},
+		link: l,
+		rng:  rand.New(rand.NewSource(seed)),
+		done: make(chan struct{}),
+	}
+}
+
+// SetLink changes the conditions of the outbound link and returns the previous
+// setting. Segments that are already in flight are not affected, and the random
+// number generator is not reseeded.
+func (c *PipeConn) SetLink(new Link) (old Link) {
+	c.lmu.Lock()
+	old, c.link = c.link, new
+	c.lmu.Unlock()
+	c.Out.SetPacing(int64(new.mtu()))
+	return
+}
+
+// Read reads data that has been delivered by the inbound link. It blocks until
+// at least one byte is available, the peer is closed (io.EOF), or the read
+// deadline is exceeded.
+func (c *PipeConn) Read(p []byte) (n int, err error) {
+	q := &c.rx
+	for {
+		ctx := c.rd.context()
+		if c.closed(false) {
+			return 0, io.ErrClosedPipe
+		}
+		if err = ctx.Err(); err != nil && err != context.Canceled {
+			return 0, deadlineErr(err)
+		}
+		var wait time.Duration
+		now := c.In.clk.Now()
+		q.mu.Lock()
+		for len(q.segs) > 0 && n < len(p) {
+			s := &q.segs[0]
+			if wait = s.at.Sub(now); wait > 0 {
+				break
+			}
+			m := copy(p[n:], s.b)
+			if n, s.b = n+m, s.b[m:]; len(s.b) == 0 {
+				q.segs[0] = pipeSegment{}
+				q.segs = q.segs[1:]
+			}
+		}
+		eof := q.eof && len(q.segs) == 0
+		q.mu.Unlock()
+		if n > 0 || len(p) == 0 {
+			return n, nil
+		} else if eof {
+			return 0, io.EOF
+		}
+		var timer <-chan time.Time
+		if wait > 0 {
+			timer = c.In.clk.After(wait)
+		}
+		select {
+		case <-timer:
+			continue
+		case <-q.wake:
+		case <-ctx.Done():
+		case <-c.done:
+		}
+		stopTimer(c.In.clk, timer)
+	}
+}
+
+// Write writes len(p) bytes from p to the outbound link. It returns once all
+// segments have been sent, without waiting for them to be delivered.
+func (c *PipeConn) Write(p []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	for len(p) > 0 {
+		l, stall, delay := c.roll()
+		want := len(p)
+		if mtu := l.mtu(); want > mtu {
+			want = mtu
+		}
+		var m int
+		for {
+			ctx := c.wd.context()
+			if c.closed(true) {
+				return n, io.ErrClosedPipe
+			}
+			if err = ctx.Err(); err == nil && stall > 0 {
+				start := c.Out.clk.Now()
+				timer := c.Out.clk.After(stall)
+				select {
+				case <-timer:
+					stall = 0
+				case <-ctx.Done():
+					stopTimer(c.Out.clk, timer)
+					stall -= c.Out.clk.Now().Sub(start)
+					err = ctx.Err()
+				}
+			}
+			if err == nil {
+				m, err = c.Out.LimitContext(ctx, want, l.Rate, true)
+			}
+			if err == nil {
+				break
+			} else if err != context.Canceled {
+				return n, deadlineErr(err)
+			}
+			// Deadline was changed or the pipe was closed, so the remaining
+			// stall time and the segment size are kept for the next attempt.
+		}
+		c.peer.rx.push(append([]byte(nil), p[:m]...), c.Out.clk.Now().Add(delay))
+		p, n = p[m:], n+c.Out.Update(m)
+	}
+	return n, nil
+}
+
+// Close closes both directions of the pipe. Subsequent reads from the peer
+// return the data that is still in flight, followed by io.EOF. All other
+// operations on either end return io.ErrClosedPipe.
+func (c *PipeConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.peer.rx.close()
+		c.rd.interrupt()
+		c.wd.interrupt()
+		c.peer.wd.interrupt()
+		c.Out.Done()
+		c.In.Done()
+	})
+	return nil
+}
+
+// LocalAddr returns the local network address.
+func (c *PipeConn) LocalAddr() net.Addr { return pipeAddr{} }
+
+// RemoteAddr returns the remote network address.
+func (c *PipeConn) RemoteAddr() net.Addr { return pipeAddr{} }
+
+// SetDeadline sets the read and write deadlines of the connection.
+func (c *PipeConn) SetDeadline(t time.Time) error {
+	c.rd.set(t)
+	c.wd.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the read deadline of the connection.
+func (c *PipeConn) SetReadDeadline(t time.Time) error {
+	c.rd.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline of the connection.
+func (c *PipeConn) SetWriteDeadline(t time.Time) error {
+	c.wd.set(t)
+	return nil
+}
+
+// closed returns true if c was closed or, if peer == true, the peer was closed.
+func (c *PipeConn) closed(peer bool) bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+	}
+	if peer {
+		select {
+		case <-c.peer.done:
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+// roll returns the current outbound link conditions, the stall time before the
+// next segment, and the delay of that segment.
+func (c *PipeConn) roll() (l Link, stall, delay time.Duration) {
+	c.lmu.Lock()
+	defer c.lmu.Unlock()
+	l = c.link
+	if l.Stall > 0 && c.rng.Float64() < l.Stall {
+		stall = l.StallTime
+	}
+	delay = l.Latency
+	if l.Jitter > 0 {
+		delay += time.Duration((2*c.rng.Float64() - 1) * float64(l.Jitter))
+	}
+	if l.Loss > 0 && c.rng.Float64() < l.Loss {
+		if l.RTO > 0 {
+			delay += l.RTO
+		} else {
+			delay += defaultRTO
+		}
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return
+}
+
+// push adds segment b to the queue, which is delivered at time at or after
+// the previous segment, whichever is later.
+func (q *pipeQueue) push(b []byte, at time.Time) {
+	q.mu.Lock()
+	if at.Before(q.last) {
+		at = q.last
+	}
+	q.segs = append(q.segs, pipeSegment{b, at})
+	q.last = at
+	q.mu.Unlock()
+	q.signal()
+}
+
+// close marks the end of the data in the queue.
+func (q *pipeQueue) close() {
+	q.mu.Lock()
+	q.eof = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+// signal wakes up the reader.
+func (q *pipeQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pipeAddr is the network address of a PipeConn.
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
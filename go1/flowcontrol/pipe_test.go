@@ -0,0 +1,188 @@
+package flowcontrol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPipe(t *testing.T) {
+	b := make([]byte, 1000)
+	c := NewManualClock(clockStart)
+	c1, c2 := Pipe(Link{Latency: _100ms}, Link{}, WithClock(c))
+	defer c1.Close()
+
+	// Make sure c1 implements net.Conn
+	_ = net.Conn(c1)
+
+	// Writes return without waiting for the data to be delivered
+	if n, err := c1.Write([]byte("hello")); n != 5 || err != nil {
+		t.Fatalf("c1.Write() expected 5 (<nil>); got %v (%v)", n, err)
+	}
+	done := make(chan string)
+	go func() {
+		n, _ := c2.Read(b)
+		done <- string(b[:n])
+	}()
+	c.BlockUntil(1)
+	c.Add(_100ms - time.Millisecond)
+	select {
+	case s := <-done:
+		t.Fatalf("c2.Read() returned %q ahead of time", s)
+	default:
+	}
+	c.Add(time.Millisecond)
+	if s := <-done; s != "hello" {
+		t.Fatalf("c2.Read() expected %q; got %q", "hello", s)
+	}
+
+	// Each direction has its own conditions
+	c2.Write([]byte("world"))
+	if n, err := c1.Read(b); string(b[:n]) != "world" || err != nil {
+		t.Fatalf("c1.Read() expected %q (<nil>); got %q (%v)", "world", b[:n], err)
+	}
+	if c1.In != c2.Out {
+		t.Fatalf("c1.In expected to be c2.Out")
+	}
+
+	// Deadline
+	c1.SetReadDeadline(time.Now().Add(-time.Second))
+	if n, err := c1.Read(b); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("c1.Read() expected 0 (%v); got %v (%v)", os.ErrDeadlineExceeded, n, err)
+	}
+
+	// Closed pipe
+	c2.Write([]byte("bye"))
+	c2.Close()
+	if _, err := c2.Read(b); err != io.ErrClosedPipe {
+		t.Fatalf("c2.Read() expected %v; got %v", io.ErrClosedPipe, err)
+	}
+	if _, err := c1.Write(b); err != io.ErrClosedPipe {
+		t.Fatalf("c1.Write() expected %v; got %v", io.ErrClosedPipe, err)
+	}
+	c1.SetReadDeadline(time.Time{})
+	if n, err := c1.Read(b); string(b[:n]) != "bye" || err != nil {
+		t.Fatalf("c1.Read() expected %q (<nil>); got %q (%v)", "bye", b[:n], err)
+	}
+	if _, err := c1.Read(b); err != io.EOF {
+		t.Fatalf("c1.Read() expected %v; got %v", io.EOF, err)
+	}
+	if s := c1.Out.Status(); s.Active {
+		t.Fatalf("c1.Out.Status() expected an inactive transfer")
+	}
+}
+
+func TestPipeRate(t *testing.T) {
+	b := make([]byte, 1000)
+	c := NewManualClock(clockStart)
+	c1, c2 := Pipe(Link{Rate: 1000, MTU: 100}, Link{}, WithClock(c))
+	defer c1.Close()
+
+	// Segments are paced at the link rate
+	done := make(chan int)
+	go func() {
+		n, _ := c1.Write(b[:300])
+		done <- n
+	}()
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			advance(c, _100ms)
+		}
+		if n, err := c2.Read(b); n != 100 || err != nil {
+			t.Fatalf("c2.Read() #%v expected 100 (<nil>); got %v (%v)", i, n, err)
+		}
+	}
+	if n := <-done; n != 300 {
+		t.Fatalf("c1.Write() expected 300; got %v", n)
+	}
+	if s := c1.Out.Status(); s.WaitTime != 2*_100ms {
+		t.Fatalf("c1.Out.Status() expected 200ms wait time; got %v", s.WaitTime)
+	}
+}
+
+func TestPipeJitter(t *testing.T) {
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	b := make([]byte, len(in))
+	c := NewManualClock(clockStart)
+	l := Link{Latency: _100ms, Jitter: _50ms, MTU: 10, Loss: 0.1, RTO: time.Second, Seed: 1}
+	c1, c2 := Pipe(l, Link{}, WithClock(c))
+	defer c1.Close()
+
+	// Segments are delayed by random amounts, but delivered in order
+	c1.Write(in)
+	c.Add(_50ms - time.Millisecond)
+	c2.SetReadDeadline(time.Now().Add(-time.Second))
+	if n, _ := c2.Read(b); n != 0 {
+		t.Fatalf("c2.Read() expected no data before the minimum delay; got %v bytes", n)
+	}
+	c2.SetReadDeadline(time.Time{})
+	c.Add(_100ms + time.Millisecond)
+	n, _ := c2.Read(b)
+	if n == 0 || n == len(in) || n%10 != 0 {
+		t.Fatalf("c2.Read() expected some segments before the lost ones; got %v bytes", n)
+	}
+	c.Add(time.Second)
+	if _, err := io.ReadFull(c2, b[n:]); err != nil || !bytes.Equal(b, in) {
+		t.Fatalf("io.ReadFull(c2) expected the original data; got %v (%v)", b, err)
+	}
+}
+
+func TestPipeStall(t *testing.T) {
+	b := make([]byte, 100)
+	c := NewManualClock(clockStart)
+	c1, c2 := Pipe(Link{Stall: 1, StallTime: time.Second}, Link{}, WithClock(c))
+	defer c1.Close()
+
+	done := make(chan int)
+	go func() {
+		n, _ := c1.Write(b)
+		done <- n
+	}()
+	c.BlockUntil(1)
+	c.Add(time.Second - time.Millisecond)
+	select {
+	case n := <-done:
+		t.Fatalf("c1.Write() returned %v during a stall", n)
+	default:
+	}
+	c.Add(time.Millisecond)
+	if n := <-done; n != 100 {
+		t.Fatalf("c1.Write() expected 100; got %v", n)
+	}
+	if n, _ := c2.Read(b); n != 100 {
+		t.Fatalf("c2.Read() expected 100; got %v", n)
+	}
+
+	// A deadline change resumes the stall instead of starting a new one
+	go func() {
+		n, _ := c1.Write(b)
+		done <- n
+	}()
+	c.BlockUntil(1)
+	c.Add(_400ms)
+	rearm(c, func() { c1.SetWriteDeadline(time.Now().Add(time.Hour)) })
+	c.Add(time.Second - _400ms)
+	if n := <-done; n != 100 {
+		t.Fatalf("c1.Write() expected 100; got %v", n)
+	}
+	c1.SetWriteDeadline(time.Time{})
+
+	// Close interrupts a stalled write
+	errc := make(chan error)
+	go func() {
+		_, err := c1.Write(b)
+		errc <- err
+	}()
+	c.BlockUntil(1)
+	c2.Close()
+	if err := <-errc; err != io.ErrClosedPipe {
+		t.Fatalf("c1.Write() expected %v; got %v", io.ErrClosedPipe, err)
+	}
+}
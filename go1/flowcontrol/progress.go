@@ -0,0 +1,204 @@
+package flowcontrol
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default Progress refresh intervals.
+const (
+	progressTTYInterval = 200 * time.Millisecond
+	progressLogInterval = 10 * time.Second
+)
+
+// Progress renders the status of one or more transfers to an io.Writer. If the
+// output is a terminal, each transfer is shown as a progress bar on its own
+// line, and all lines are redrawn in place at every refresh. Otherwise, a log
+// line is written for each active transfer at every refresh and once more when
+// the transfer is done.
+type Progress struct {
+	Width int  // Progress bar width in characters
+	TTY   bool // Flag indicating terminal output (detected by NewProgress)
+
+	w        io.Writer     // Output destination
+	interval time.Duration // Refresh interval
+
+	mu    sync.Mutex    // Mutex guarding access to the fields below
+	bars  []*bar        // Transfers in the order they were added
+	lines int           // Number of lines drawn by the previous refresh
+	stop  chan struct{} // Channel closed by Stop
+	done  chan struct{} // Channel closed when the refresh goroutine exits
+}
+
+// bar is a single transfer rendered by Progress.
+type bar struct {
+	name string       // Transfer name
+	src  StatusSource // Transfer status source
+	done bool         // Flag indicating that the final status was logged
+}
+
+// NewProgress returns a new Progress that writes to w every interval. If
+// interval <= 0, the default of 200ms is used for terminals and 10s for all
+// other outputs. The exported fields may be changed before calling Start.
+func NewProgress(w io.Writer, interval time.Duration) *Progress {
+	p := &Progress{Width: 30, TTY: isTerminal(w), w: w, interval: interval}
+	if p.interval <= 0 {
+		if p.interval = progressLogInterval; p.TTY {
+			p.interval = progressTTYInterval
+		}
+	}
+	return p
+}
+
+// Add adds a transfer with the given name to the output. src is typically a
+// Monitor, Reader, or Writer.
+func (p *Progress) Add(name string, src StatusSource) {
+	p.mu.Lock()
+	p.bars = append(p.bars, &bar{name: name, src: src})
+	p.mu.Unlock()
+}
+
+// Start starts refreshing the output in a separate goroutine.
+func (p *Progress) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		return
+	}
+	p.stop, p.done = make(chan struct{}), make(chan struct{})
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		t := time.NewTicker(p.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				p.Draw()
+			case <-stop:
+				return
+			}
+		}
+	}(p.stop, p.done)
+}
+
+// Stop stops refreshing the output and draws the final status of all
+// transfers.
+func (p *Progress) Stop() {
+	p.mu.Lock()
+	stop, done := p.stop, p.done
+	p.stop, p.done = nil, nil
+	p.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	p.Draw()
+}
+
+// Draw refreshes the output immediately.
+func (p *Progress) Draw() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	width := 0
+	for _, b := range p.bars {
+		if len(b.name) > width {
+			width = len(b.name)
+		}
+	}
+	var sb strings.Builder
+	if p.TTY {
+		if p.lines > 0 {
+			sb.WriteString("\x1b[" + strconv.Itoa(p.lines) + "A")
+		}
+		for _, b := range p.bars {
+			s := b.src.Status()
+			sb.WriteString("\r")
+			p.format(&sb, b.name, width, &s)
+			sb.WriteString("\x1b[K\n")
+		}
+		p.lines = len(p.bars)
+	} else {
+		for _, b := range p.bars {
+			if b.done {
+				continue
+			}
+			s := b.src.Status()
+			b.done = !s.Active
+			p.format(&sb, b.name, width, &s)
+			sb.WriteByte('\n')
+		}
+	}
+	if sb.Len() == 0 {
+		return nil
+	}
+	_, err := io.WriteString(p.w, sb.String())
+	return err
+}
+
+// format writes a single line describing the transfer status s to sb. The bar
+// is only included in terminal output.
+func (p *Progress) format(sb *strings.Builder, name string, width int, s *Status) {
+	sb.WriteString(name)
+	if p.TTY {
+		sb.WriteString(strings.Repeat(" ", width-len(name)))
+	} else {
+		sb.WriteByte(':')
+	}
+	sized := s.BytesRem > 0 || s.Progress > 0
+	if sized && p.TTY && p.Width > 0 {
+		n := int(s.Progress.Float() / 100 * float64(p.Width))
+		if n > p.Width {
+			n = p.Width
+		}
+		sb.WriteString(" [" + strings.Repeat("=", n))
+		if n < p.Width {
+			sb.WriteString(">" + strings.Repeat(" ", p.Width-n-1))
+		}
+		sb.WriteByte(']')
+	}
+	if sized {
+		sb.WriteString(" " + strconv.FormatFloat(s.Progress.Float(), 'f', 1, 64) + "%")
+	}
+	sb.WriteString(" " + Size(s.Bytes).FormatUnits(IEC, 1))
+	if !s.Active {
+		sb.WriteString(" " + Rate(s.AvgRate).FormatUnits(IEC, 1))
+		sb.WriteString(" done in " + formatDuration(s.Duration))
+	} else {
+		sb.WriteString(" " + Rate(s.CurRate).FormatUnits(IEC, 1))
+		if sized && s.TimeRem > 0 {
+			sb.WriteString(" ETA " + formatDuration(s.TimeRem))
+		}
+	}
+}
+
+// formatDuration returns d rounded to the nearest second in the format
+// [h:]mm:ss.
+func formatDuration(d time.Duration) string {
+	s := int64((d + time.Second/2) / time.Second)
+	h, m := s/3600, s/60%60
+	s %= 60
+	pad := func(v int64) string {
+		if v < 10 {
+			return "0" + strconv.FormatInt(v, 10)
+		}
+		return strconv.FormatInt(v, 10)
+	}
+	if h > 0 {
+		return strconv.FormatInt(h, 10) + ":" + pad(m) + ":" + pad(s)
+	}
+	return pad(m) + ":" + pad(s)
+}
+
+// isTerminal returns true if w is a character device, such as a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,70 @@
+package flowcontrol
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	c := NewManualClock(clockStart)
+	a := New(_100ms, time.Second, WithClock(c))
+	a.SetTransferSize(1 << 20)
+	b := New(_100ms, time.Second, WithClock(c))
+
+	var buf strings.Builder
+	p := NewProgress(&buf, 0)
+	if p.TTY || p.interval != progressLogInterval {
+		t.Fatalf("NewProgress() expected log output every %v; got TTY=%v every %v",
+			progressLogInterval, p.TTY, p.interval)
+	}
+	p.Width = 10
+	p.Add("a", a)
+	p.Add("bb", b)
+	a.Update(256 << 10)
+	b.Update(1500)
+	c.Add(time.Second)
+
+	// Log lines
+	p.Draw()
+	want := "a: 25.0% 256.0KiB 256.0KiB/s ETA 00:03\n" +
+		"bb: 1.5KiB 1.5KiB/s\n"
+	if buf.String() != want {
+		t.Fatalf("p.Draw() expected %q; got %q", want, buf.String())
+	}
+	buf.Reset()
+	a.Done()
+	p.Draw()
+	p.Draw()
+	want = "a: 25.0% 256.0KiB 256.0KiB/s done in 00:01\n" +
+		"bb: 1.5KiB 1.5KiB/s\n" +
+		"bb: 1.5KiB 1.5KiB/s\n"
+	if buf.String() != want {
+		t.Fatalf("p.Draw() expected %q; got %q", want, buf.String())
+	}
+
+	// Terminal output
+	buf.Reset()
+	p.TTY = true
+	p.Draw()
+	p.Draw()
+	line := "\ra  [==>       ] 25.0% 256.0KiB 256.0KiB/s done in 00:01\x1b[K\n" +
+		"\rbb 1.5KiB 1.5KiB/s\x1b[K\n"
+	want = line + "\x1b[2A" + line
+	if buf.String() != want {
+		t.Fatalf("p.Draw() expected %q; got %q", want, buf.String())
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		0:                       "00:00",
+		1499 * time.Millisecond: "00:01",
+		62 * time.Second:        "01:02",
+		3723 * time.Second:      "1:02:03",
+	} {
+		if got := formatDuration(d); got != want {
+			t.Errorf("formatDuration(%v) expected %q; got %q", d, want, got)
+		}
+	}
+}
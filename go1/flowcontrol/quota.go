@@ -0,0 +1,283 @@
+package flowcontrol
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned by Limit, Reader, and Writer when the transfer
+// quota for the current period has been used up.
+var ErrQuotaExceeded = errors.New("flowcontrol: transfer quota exceeded")
+
+// Period determines how often a Quota is reset.
+type Period int
+
+const (
+	Forever Period = iota // Never reset
+	Daily                 // Reset at midnight
+	Weekly                // Reset at midnight on Monday
+	Monthly               // Reset at midnight on the first day of the month
+)
+
+// start returns the start time of the period that contains t.
+func (p Period) start(t time.Time) time.Time {
+	y, m, d := t.Date()
+	switch p {
+	case Daily:
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	case Weekly:
+		wd := (int(t.Weekday()) + 6) % 7 // Days since Monday
+		return time.Date(y, m, d-wd, 0, 0, 0, 0, t.Location())
+	case Monthly:
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Time{}
+}
+
+// QuotaStore persists the state of quotas across restarts.
+type QuotaStore interface {
+	// Load returns the number of bytes used by quota name in the period that
+	// started at time start. It returns (0, zero time, nil) if there is no
+	// saved state.
+	Load(name string) (used int64, start time.Time, err error)
+
+	// Save saves the state of quota name.
+	Save(name string, used int64, start time.Time) error
+}
+
+// quotaSaveInterval is the minimum time between automatic saves of the quota
+// state.
+const quotaSaveInterval = time.Second
+
+// Quota enforces a maximum number of bytes that may be transferred per period.
+// A Quota may be shared by multiple Monitors (see WithQuota), which are allowed
+// to transfer data until the total for the current period reaches the limit.
+// Periods begin at midnight in the local time zone.
+type Quota struct {
+	mu     sync.Mutex
+	clk    Clock      // Time source
+	name   string     // Store key
+	limit  int64      // Maximum number of bytes per period (unlimited when <= 0)
+	period Period     // Reset period
+	store  QuotaStore // Persistent storage (nil if none)
+	used   int64      // Number of bytes used in the current period
+	start  time.Time  // Start time of the current period
+	saved  time.Time  // Time of the most recent save
+	dirty  bool       // Flag indicating unsaved changes
+	saving bool       // Flag indicating a background save in progress
+	err    error      // First store error since the previous Sync
+
+	smu sync.Mutex     // Mutex serializing saves
+	bg  sync.WaitGroup // Background saves in progress
+}
+
+// NewQuota creates a new quota that allows limit bytes to be transferred per
+// period. If store is not nil, the previously saved state of the quota with the
+// given name is loaded from it and all changes are saved periodically. Periods
+// are measured by clk, which should be the clock of the Monitors that use the
+// quota (see WithClock). If clk is nil, the time package is used.
+func NewQuota(name string, limit int64, period Period, store QuotaStore, clk Clock) (*Quota, error) {
+	if clk == nil {
+		clk = sysClock{}
+	}
+	q := &Quota{clk: clk, name: name, limit: limit, period: period, store: store}
+	if store != nil {
+		used, start, err := store.Load(name)
+		if err != nil {
+			return nil, err
+		}
+		q.used, q.start = used, start.Local()
+	}
+	return q, nil
+}
+
+// WithQuota restricts the new Monitor to the remaining quota of q.
+func WithQuota(q *Quota) Option {
+	return func(m *Monitor) {
+		m.quota = q
+	}
+}
+
+// Remaining returns the number of bytes that may still be transferred in the
+// current period, or -1 if the quota is unlimited.
+func (q *Quota) Remaining() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.remaining()
+}
+
+// SetLimit changes the maximum number of bytes per period to new and returns
+// the previous setting.
+func (q *Quota) SetLimit(new int64) (old int64) {
+	q.mu.Lock()
+	old, q.limit = q.limit, new
+	q.mu.Unlock()
+	return
+}
+
+// Reset clears the number of bytes used in the current period.
+func (q *Quota) Reset() {
+	q.mu.Lock()
+	q.used, q.dirty = 0, true
+	q.mu.Unlock()
+}
+
+// Sync waits for any automatic save in progress and then saves the current
+// state of the quota to the store. It returns the first error encountered by
+// this or an automatic save since the previous call, if any. Sync should be
+// called before the store is removed or the program exits.
+func (q *Quota) Sync() error {
+	q.bg.Wait()
+	q.save()
+	q.mu.Lock()
+	err := q.err
+	q.err = nil
+	q.mu.Unlock()
+	return err
+}
+
+// remaining returns the remaining quota, or -1 if the quota is unlimited. The
+// caller must hold q.mu.
+func (q *Quota) remaining() int64 {
+	if q.limit <= 0 {
+		return -1
+	}
+	q.roll(q.clk.Now())
+	if rem := q.limit - q.used; rem > 0 {
+		return rem
+	}
+	return 0
+}
+
+// consume records the transfer of n bytes. The state is saved in the
+// background, so that the caller is not blocked by the store.
+func (q *Quota) consume(n int64) {
+	t := q.clk.Now()
+	q.mu.Lock()
+	q.roll(t)
+	q.used += n
+	q.dirty = true
+	bg := q.store != nil && !q.saving && t.Sub(q.saved) >= quotaSaveInterval
+	if bg {
+		q.saving, q.saved = true, t
+		q.bg.Add(1)
+	}
+	q.mu.Unlock()
+	if bg {
+		go func() {
+			q.save()
+			q.mu.Lock()
+			q.saving = false
+			q.mu.Unlock()
+			q.bg.Done()
+		}()
+	}
+}
+
+// roll starts a new period if t is not in the current one. The caller must hold
+// q.mu.
+func (q *Quota) roll(t time.Time) {
+	if start := q.period.start(t.Local()); start.After(q.start) {
+		q.used, q.start, q.dirty = 0, start, true
+	}
+}
+
+// save saves the quota state if it has changed and records the error, if any.
+// The caller must not hold q.mu. Saves are serialized, so the most recent state
+// is always saved last.
+func (q *Quota) save() {
+	q.smu.Lock()
+	defer q.smu.Unlock()
+	q.mu.Lock()
+	if q.store == nil || !q.dirty {
+		q.mu.Unlock()
+		return
+	}
+	used, start := q.used, q.start
+	q.dirty = false
+	q.mu.Unlock()
+	err := q.store.Save(q.name, used, start)
+	if err != nil {
+		q.mu.Lock()
+		if q.dirty = true; q.err == nil {
+			q.err = err
+		}
+		q.mu.Unlock()
+	}
+}
+
+// FileQuotaStore is a QuotaStore that keeps the state of all quotas in a single
+// JSON file.
+type FileQuotaStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// quotaState is the saved state of a single quota.
+type quotaState struct {
+	Used  int64     `json:"used"`
+	Start time.Time `json:"start"`
+}
+
+// NewFileQuotaStore returns a store that uses the file at path, which is
+// created on the first save.
+func NewFileQuotaStore(path string) *FileQuotaStore {
+	return &FileQuotaStore{path: path}
+}
+
+// Load implements QuotaStore.
+func (s *FileQuotaStore) Load(name string) (int64, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all, err := s.read()
+	st := all[name]
+	return st.Used, st.Start, err
+}
+
+// Save implements QuotaStore. The file is replaced atomically.
+func (s *FileQuotaStore) Save(name string, used int64, start time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all, err := s.read()
+	if err != nil {
+		return err
+	}
+	all[name] = quotaState{used, start}
+	b, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// read returns the state of all quotas in the file.
+func (s *FileQuotaStore) read() (map[string]quotaState, error) {
+	all := make(map[string]quotaState)
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return all, err
+	}
+	return all, json.Unmarshal(b, &all)
+}
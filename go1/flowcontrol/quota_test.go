@@ -0,0 +1,119 @@
+package flowcontrol
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// blockStore is a QuotaStore whose Save calls block until release is closed.
+type blockStore struct {
+	QuotaStore
+	release chan struct{}
+}
+
+func (s *blockStore) Save(name string, used int64, start time.Time) error {
+	<-s.release
+	return s.QuotaStore.Save(name, used, start)
+}
+
+func TestQuota(t *testing.T) {
+	c := NewManualClock(clockStart)
+	store := NewFileQuotaStore(filepath.Join(t.TempDir(), "quota.json"))
+	q, err := NewQuota("user", 100, Daily, store, c)
+	if err != nil {
+		t.Fatalf("NewQuota() unexpected error: %v", err)
+	}
+	b := make([]byte, 60)
+	r := NewReader(bytes.NewReader(make([]byte, 1000)), 0, WithClock(c), WithQuota(q))
+
+	// Reads are restricted to the remaining quota
+	if n, err := r.Read(b); n != 60 || err != nil {
+		t.Fatalf("r.Read(b) expected 60 (<nil>); got %v (%v)", n, err)
+	}
+	if s := r.Status(); s.QuotaRem != 40 {
+		t.Fatalf("r.Status().QuotaRem expected 40; got %v", s.QuotaRem)
+	}
+	if n, err := r.Read(b); n != 40 || err != nil {
+		t.Fatalf("r.Read(b) expected 40 (<nil>); got %v (%v)", n, err)
+	}
+	if n, err := r.Read(b); n != 0 || err != ErrQuotaExceeded {
+		t.Fatalf("r.Read(b) expected 0 (ErrQuotaExceeded); got %v (%v)", n, err)
+	}
+
+	// The quota is shared by all Monitors and persisted in the store
+	if err := q.Sync(); err != nil {
+		t.Fatalf("q.Sync() unexpected error: %v", err)
+	}
+	midnight := Daily.start(clockStart.Local())
+	if used, start, err := store.Load("user"); used != 100 || !start.Equal(midnight) || err != nil {
+		t.Fatalf("store.Load() expected 100 %v (<nil>); got %v %v (%v)", midnight, used, start, err)
+	}
+	q2, err := NewQuota("user", 100, Daily, store, c)
+	if err != nil {
+		t.Fatalf("NewQuota() unexpected error: %v", err)
+	}
+	w := NewWriter(&bytes.Buffer{}, 0, WithClock(c), WithQuota(q2))
+	if n, err := w.Write(b); n != 0 || err != ErrQuotaExceeded {
+		t.Fatalf("w.Write(b) expected 0 (ErrQuotaExceeded); got %v (%v)", n, err)
+	}
+	if s := w.Status(); s.QuotaRem != 0 {
+		t.Fatalf("w.Status().QuotaRem expected 0; got %v", s.QuotaRem)
+	}
+
+	// The quota is reset at the start of the next period
+	c.Set(midnight.AddDate(0, 0, 1))
+	if n, err := w.Write(b); n != 60 || err != nil {
+		t.Fatalf("w.Write(b) expected 60 (<nil>); got %v (%v)", n, err)
+	}
+	if s := w.Status(); s.QuotaRem != 40 {
+		t.Fatalf("w.Status().QuotaRem expected 40; got %v", s.QuotaRem)
+	}
+	w.Done()
+	if s, rem := w.Status(), q2.Remaining(); s.QuotaRem != 40 || rem != 40 {
+		t.Fatalf("QuotaRem and q2.Remaining() expected 40 after Done; got %v and %v", s.QuotaRem, rem)
+	}
+	if err := q2.Sync(); err != nil {
+		t.Fatalf("q2.Sync() unexpected error: %v", err)
+	}
+	if s := NewReader(nil, 0, WithClock(c)).Status(); s.QuotaRem != -1 {
+		t.Fatalf("Status().QuotaRem expected -1 without a quota; got %v", s.QuotaRem)
+	}
+
+	// Transfers are not blocked by a slow store
+	bs := &blockStore{store, make(chan struct{})}
+	q3, _ := NewQuota("slow", 100, Daily, bs, c)
+	w = NewWriter(&bytes.Buffer{}, 0, WithClock(c), WithQuota(q3))
+	for i := 0; i < 2; i++ {
+		if n, err := w.Write(b[:10]); n != 10 || err != nil {
+			t.Fatalf("w.Write(b[:10]) expected 10 (<nil>); got %v (%v)", n, err)
+		}
+		c.Add(time.Second)
+	}
+	close(bs.release)
+	if err := q3.Sync(); err != nil {
+		t.Fatalf("q3.Sync() unexpected error: %v", err)
+	}
+	if used, _, _ := store.Load("slow"); used != 20 {
+		t.Fatalf("store.Load() expected 20; got %v", used)
+	}
+}
+
+func TestPeriod(t *testing.T) {
+	now := time.Date(2024, 1, 17, 15, 30, 0, 0, time.UTC) // Wednesday
+	tests := []struct {
+		p    Period
+		want time.Time
+	}{
+		{Forever, time.Time{}},
+		{Daily, time.Date(2024, 1, 17, 0, 0, 0, 0, time.UTC)},
+		{Weekly, time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{Monthly, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		if got := test.p.start(now); !got.Equal(test.want) {
+			t.Errorf("Period(%v).start() expected %v; got %v", test.p, test.want, got)
+		}
+	}
+}
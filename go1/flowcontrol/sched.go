@@ -0,0 +1,109 @@
+package flowcontrol
+
+import (
+	"math"
+	"time"
+)
+
+// share is the scheduling state of a single Group member.
+type share struct {
+	weight float64       // Relative weight
+	demand int64         // Member rate limit (unlimited when <= 0)
+	last   time.Duration // Time of the most recent Limit call
+	rate   float64       // Allocated rate (bytes per second)
+}
+
+// defaultWeight is the initial weight of every Monitor.
+const defaultWeight = 1
+
+// SetWeight changes the relative weight of the Monitor within its Group to new
+// and returns the previous setting. A member with a weight of 4 receives four
+// times the share of the group limit that is given to a member with a weight of
+// 1, unless it is restricted by its own limit. Any value <= 0 restores the
+// default weight of 1. The weight is ignored if the Monitor is not a member of
+// a Group.
+func (m *Monitor) SetWeight(new float64) (old float64) {
+	if new <= 0 {
+		new = defaultWeight
+	}
+	m.mu.Lock()
+	old, m.weight = m.weight, new
+	if m.group != nil {
+		m.group.setWeight(m, new)
+	}
+	m.mu.Unlock()
+	return
+}
+
+// idleTime returns the time after which a member that did not call Limit is
+// considered to be idle. Idle members do not receive a share of the group limit
+// until they call Limit again.
+func (g *Group) idleTime() time.Duration {
+	return 2 * g.agg.sRate
+}
+
+// schedule recalculates the shares of all group members. The caller must hold
+// g.mu.
+func (g *Group) schedule(now time.Duration) {
+	idle := g.idleTime()
+	shares := make([]*share, 0, len(g.members))
+	weights := make([]float64, 0, len(g.members))
+	demands := make([]float64, 0, len(g.members))
+	for _, s := range g.members {
+		d := math.Inf(1)
+		if now-s.last > idle {
+			d = 0
+		} else if s.demand > 0 {
+			d = float64(s.demand)
+		}
+		shares = append(shares, s)
+		weights = append(weights, s.weight)
+		demands = append(demands, d)
+	}
+	alloc := maxMin(float64(g.limit), weights, demands)
+	for i, s := range shares {
+		s.rate = alloc[i]
+	}
+	g.dirty = false
+	g.aTime = now
+}
+
+// maxMin divides total among flows with the given weights and demands using
+// weighted max-min fairness. Each flow receives an amount proportional to its
+// weight, but never more than its demand. Whatever is not used by the flows
+// whose demand is satisfied is redistributed among the remaining flows.
+func maxMin(total float64, weights, demands []float64) []float64 {
+	alloc := make([]float64, len(weights))
+	open := make([]int, 0, len(weights))
+	for i, d := range demands {
+		if d > 0 && weights[i] > 0 {
+			open = append(open, i)
+		}
+	}
+	for len(open) > 0 && total > 0 {
+		var wsum float64
+		for _, i := range open {
+			wsum += weights[i]
+		}
+		fair := total / wsum
+
+		// Satisfy all flows whose demand is below their fair share
+		next := open[:0]
+		for _, i := range open {
+			if d := demands[i]; d <= fair*weights[i] {
+				alloc[i] = d
+				total -= d
+			} else {
+				next = append(next, i)
+			}
+		}
+		if len(next) == len(open) {
+			for _, i := range open {
+				alloc[i] = fair * weights[i]
+			}
+			break
+		}
+		open = next
+	}
+	return alloc
+}
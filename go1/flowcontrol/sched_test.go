@@ -0,0 +1,68 @@
+package flowcontrol
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestMaxMin(t *testing.T) {
+	inf := math.Inf(1)
+	tests := []struct {
+		total            float64
+		weights, demands []float64
+		want             []float64
+	}{
+		{100, []float64{1, 1}, []float64{inf, inf}, []float64{50, 50}},
+		{100, []float64{4, 1}, []float64{inf, inf}, []float64{80, 20}},
+		{100, []float64{1, 1, 1}, []float64{10, inf, inf}, []float64{10, 45, 45}},
+		{100, []float64{4, 1}, []float64{30, inf}, []float64{30, 70}},
+		{100, []float64{1, 1}, []float64{0, inf}, []float64{0, 100}},
+		{100, []float64{1, 1}, []float64{20, 30}, []float64{20, 30}},
+		{100, []float64{1, 2, 1}, []float64{inf, 10, 60}, []float64{45, 10, 45}},
+		{100, nil, nil, []float64{}},
+	}
+	for _, test := range tests {
+		got := maxMin(test.total, test.weights, test.demands)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("maxMin(%v, %v, %v) expected %v; got %v",
+				test.total, test.weights, test.demands, test.want, got)
+		}
+	}
+}
+
+func TestGroupWeight(t *testing.T) {
+	b := make([]byte, 100)
+	c := NewManualClock(clockStart)
+	g := NewGroup(500, WithClock(c))
+	w1 := NewWriter(&bytes.Buffer{}, 0, WithClock(c), WithGroup(g))
+	w2 := NewWriter(&bytes.Buffer{}, 0, WithClock(c), WithGroup(g))
+	w1.SetBlocking(false)
+	w2.SetBlocking(false)
+
+	// Make sure both members are active
+	w2.Limit(1, 0, false)
+	if old := w1.SetWeight(4); old != 1 {
+		t.Fatalf("w1.SetWeight(4) expected 1; got %v", old)
+	}
+
+	// 400 and 100 bytes per second
+	if n, err := w1.Write(b); n != 40 || err != ErrLimit {
+		t.Fatalf("w1.Write(b) expected 40 (ErrLimit); got %v (%v)", n, err)
+	}
+	if n, err := w2.Write(b); n != 10 || err != ErrLimit {
+		t.Fatalf("w2.Write(b) expected 10 (ErrLimit); got %v (%v)", n, err)
+	}
+
+	// Member limit is below its share, remainder goes to the other member
+	w1.SetLimit(300)
+	if n, err := w1.Write(b); n != 0 || err != ErrLimit {
+		t.Fatalf("w1.Write(b) expected 0 (ErrLimit); got %v (%v)", n, err)
+	}
+	if n, err := w2.Write(b); n != 10 || err != ErrLimit {
+		t.Fatalf("w2.Write(b) expected 10 (ErrLimit); got %v (%v)", n, err)
+	}
+	w1.Close()
+	w2.Close()
+}
@@ -0,0 +1,140 @@
+package flowcontrol
+
+import "time"
+
+// Window is a recurring daily time window with its own rate limit. Start and
+// End are wall clock offsets from midnight. If End <= Start, the window ends on
+// the following day, so a window from 22:00 to 06:00 covers the night and a
+// window with Start == End lasts 24 hours.
+type Window struct {
+	Days  []time.Weekday // Days on which the window starts (every day if empty)
+	Start time.Duration  // Start time of day (inclusive)
+	End   time.Duration  // End time of day (exclusive)
+	Limit int64          // Rate limit in bytes per second (unlimited when <= 0)
+}
+
+// Schedule changes the rate limit by time of day. The limit at any given time
+// is the limit of the first Window that contains it, or Default if there is no
+// such window.
+type Schedule struct {
+	Windows  []Window       // Time windows in order of precedence
+	Default  int64          // Rate limit outside of all windows
+	Location *time.Location // Time zone of all windows (time.Local if nil)
+	Clock    Clock          // Time source used by Attach (system clock if nil)
+}
+
+// LimitAt returns the rate limit at time t.
+func (s *Schedule) LimitAt(t time.Time) int64 {
+	t = t.In(s.location())
+	tod := timeOfDay(t)
+	wd := t.Weekday()
+	for i := range s.Windows {
+		if w := &s.Windows[i]; w.contains(wd, tod) {
+			return w.Limit
+		}
+	}
+	return s.Default
+}
+
+// Next returns the first time after t at which the limit may change. It returns
+// the zero time if the schedule has no windows.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.In(s.location())
+	var next time.Time
+	for i := range s.Windows {
+		w := &s.Windows[i]
+		for _, tod := range [2]time.Duration{w.Start, w.End} {
+			if b := nextTimeOfDay(t, tod); next.IsZero() || b.Before(next) {
+				next = b
+			}
+		}
+	}
+	return next
+}
+
+// Attach sets the limit of l according to the schedule and keeps it updated as
+// windows begin and end. If hook is not nil, it is called with the old and new
+// limits whenever the limit is changed. Call the returned function to detach
+// the schedule from l. The schedule must not be modified while it is attached.
+func (s *Schedule) Attach(l Limiter, hook func(old, new int64)) (stop func()) {
+	clk := s.Clock
+	if clk == nil {
+		clk = sysClock{}
+	}
+	done := make(chan struct{})
+	apply := func(now time.Time) {
+		new := s.LimitAt(now)
+		if old := l.SetLimit(new); old != new && hook != nil {
+			hook(old, new)
+		}
+	}
+	now := clk.Now()
+	apply(now)
+	go func() {
+		for {
+			var timer <-chan time.Time
+			if next := s.Next(now); !next.IsZero() {
+				timer = clk.After(next.Sub(now))
+			}
+			select {
+			case <-timer:
+			case <-done:
+				stopTimer(clk, timer)
+				return
+			}
+			now = clk.Now()
+			apply(now)
+		}
+	}()
+	return func() { close(done) }
+}
+
+// location returns the time zone of the schedule.
+func (s *Schedule) location() *time.Location {
+	if s.Location != nil {
+		return s.Location
+	}
+	return time.Local
+}
+
+// contains returns true if the window contains the time of day tod on weekday
+// wd.
+func (w *Window) contains(wd time.Weekday, tod time.Duration) bool {
+	if w.Start < w.End {
+		return w.Start <= tod && tod < w.End && w.on(wd)
+	}
+	return (tod >= w.Start && w.on(wd)) || (tod < w.End && w.on((wd+6)%7))
+}
+
+// on returns true if the window starts on weekday wd.
+func (w *Window) on(wd time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == wd {
+			return true
+		}
+	}
+	return false
+}
+
+// timeOfDay returns the wall clock time of t as an offset from midnight.
+func timeOfDay(t time.Time) time.Duration {
+	h, m, s := t.Clock()
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute +
+		time.Duration(s)*time.Second + time.Duration(t.Nanosecond())
+}
+
+// nextTimeOfDay returns the first time after t with the wall clock time tod.
+func nextTimeOfDay(t time.Time, tod time.Duration) time.Time {
+	y, m, d := t.Date()
+	h, mi, s, ns := tod/time.Hour, tod/time.Minute%60, tod/time.Second%60, tod%time.Second
+	for {
+		next := time.Date(y, m, d, int(h), int(mi), int(s), int(ns), t.Location())
+		if next.After(t) {
+			return next
+		}
+		d++
+	}
+}
@@ -0,0 +1,83 @@
+package flowcontrol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestScheduleLimitAt(t *testing.T) {
+	weekdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday,
+		time.Thursday, time.Friday}
+	s := &Schedule{
+		Windows: []Window{
+			{weekdays, 9 * time.Hour, 17 * time.Hour, 5000},
+			{nil, 22 * time.Hour, 6 * time.Hour, 1000},
+		},
+		Location: time.UTC,
+	}
+	tests := []struct {
+		t     time.Time
+		limit int64
+		next  time.Time
+	}{
+		// Monday, January 1st 2024
+		{date(1, 8, 59), 0, date(1, 9, 0)},
+		{date(1, 9, 0), 5000, date(1, 17, 0)},
+		{date(1, 16, 59), 5000, date(1, 17, 0)},
+		{date(1, 17, 0), 0, date(1, 22, 0)},
+		{date(1, 23, 0), 1000, date(2, 6, 0)},
+		{date(2, 5, 59), 1000, date(2, 6, 0)},
+		{date(2, 6, 0), 0, date(2, 9, 0)},
+
+		// Saturday
+		{date(6, 12, 0), 0, date(6, 17, 0)},
+		{date(7, 3, 0), 1000, date(7, 6, 0)},
+	}
+	for _, test := range tests {
+		if limit := s.LimitAt(test.t); limit != test.limit {
+			t.Errorf("s.LimitAt(%v) expected %v; got %v", test.t, test.limit, limit)
+		}
+		if next := s.Next(test.t); !next.Equal(test.next) {
+			t.Errorf("s.Next(%v) expected %v; got %v", test.t, test.next, next)
+		}
+	}
+	if next := (&Schedule{}).Next(date(1, 0, 0)); !next.IsZero() {
+		t.Errorf("Schedule{}.Next() expected zero time; got %v", next)
+	}
+}
+
+func TestScheduleAttach(t *testing.T) {
+	c := NewManualClock(date(1, 8, 0))
+	s := &Schedule{
+		Windows:  []Window{{nil, 9 * time.Hour, 17 * time.Hour, 5000}},
+		Default:  100,
+		Location: time.UTC,
+		Clock:    c,
+	}
+	w := NewWriter(&bytes.Buffer{}, 0, WithClock(c))
+	changes := make(chan [2]int64, 1)
+	stop := s.Attach(w, func(old, new int64) {
+		changes <- [2]int64{old, new}
+	})
+	defer stop()
+	if ch := <-changes; ch != [2]int64{0, 100} {
+		t.Fatalf("hook expected [0 100]; got %v", ch)
+	}
+	advance(c, time.Hour)
+	if ch := <-changes; ch != [2]int64{100, 5000} {
+		t.Fatalf("hook expected [100 5000]; got %v", ch)
+	}
+	if limit := w.SetLimit(5000); limit != 5000 {
+		t.Fatalf("w.SetLimit() expected 5000; got %v", limit)
+	}
+	advance(c, 8*time.Hour)
+	if ch := <-changes; ch != [2]int64{5000, 100} {
+		t.Fatalf("hook expected [5000 100]; got %v", ch)
+	}
+}
+
+// date returns the given time in January 2024 in UTC.
+func date(day, hour, min int) time.Time {
+	return time.Date(2024, time.January, day, hour, min, 0, 0, time.UTC)
+}
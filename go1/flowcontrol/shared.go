@@ -0,0 +1,275 @@
+package flowcontrol
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backend is the shared state of rate limits that are enforced across multiple
+// processes. Time is divided into fixed windows, and each limit may allow rate
+// * window bytes to be transferred per window by all processes combined.
+type Backend interface {
+	// Reserve reserves up to n bytes from the allowance of limit key in the
+	// current window, where rate is the limit in bytes per second. It returns
+	// the number of bytes reserved (0 <= granted <= n) and the time remaining
+	// until the end of the window, when a new allowance becomes available.
+	Reserve(ctx context.Context, key string, n, rate int64) (granted int64, ttl time.Duration, err error)
+}
+
+// MemBackend is a Backend that keeps the shared state in memory. It may be used
+// by multiple SharedLimits in one process directly or by multiple processes
+// via a Coordinator.
+type MemBackend struct {
+	clk    Clock         // Time source
+	window time.Duration // Window length
+
+	mu     sync.Mutex
+	limits map[string]*memLimit // Limit state by key
+}
+
+// memLimit is the state of one MemBackend limit.
+type memLimit struct {
+	start time.Time // Start time of the current window
+	used  int64     // Number of bytes reserved in the current window
+}
+
+// NewMemBackend returns a new MemBackend with the given window length (1s if
+// window <= 0). Windows are aligned to multiples of the window length since the
+// zero time. If clk is nil, the time package is used.
+func NewMemBackend(window time.Duration, clk Clock) *MemBackend {
+	if window <= 0 {
+		window = time.Second
+	}
+	if clk == nil {
+		clk = sysClock{}
+	}
+	return &MemBackend{clk: clk, window: window, limits: make(map[string]*memLimit)}
+}
+
+// Reserve implements Backend.
+func (b *MemBackend) Reserve(_ context.Context, key string, n, rate int64) (int64, time.Duration, error) {
+	now := b.clk.Now()
+	start := now.Truncate(b.window)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l := b.limits[key]
+	if l == nil {
+		l = new(memLimit)
+		b.limits[key] = l
+	}
+	if !l.start.Equal(start) {
+		l.start, l.used = start, 0
+	}
+	if avail := b.allowance(rate) - l.used; n > avail {
+		n = avail
+	}
+	if n < 0 {
+		n = 0
+	}
+	l.used += n
+	return n, start.Add(b.window).Sub(now), nil
+}
+
+// allowance returns the number of bytes that may be reserved per window at the
+// given rate.
+func (b *MemBackend) allowance(rate int64) int64 {
+	if n := round(float64(rate) * b.window.Seconds()); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// SharedLimit is a rate limit that is shared by Monitors in multiple processes,
+// such as a bandwidth cap for all hosts running the same service. Monitors that
+// use the limit (see WithShared) lease bytes from the Backend in batches and
+// draw their allowances from the local lease, so most Limit calls do not
+// require a round trip. The Backend charges bytes when they are leased, and
+// unused leased bytes expire at the end of the Backend window. Thus, the
+// combined rate of all processes does not exceed the limit, but it may fall
+// short of it if the lease size is large relative to the amount of data
+// transferred by each process. Locally, as with the allowance of a Monitor,
+// bytes are removed from the lease when they are reported by Update, and bytes
+// transferred in excess of the lease are deducted from the next one.
+//
+// Non-blocking Limit calls never wait for the Backend. If the lease must be
+// renewed, the request is sent in the background and the call returns 0. After
+// a Backend error, requests are retried with an exponential backoff, and Limit
+// calls return the error until the next attempt. Requests that take longer than
+// 10 seconds are canceled and treated as errors.
+//
+// The embedded Monitor collects the aggregate statistics of all local transfers.
+type SharedLimit struct {
+	*Monitor // Aggregate statistics of local transfers
+
+	b     Backend      // Shared state
+	key   string       // Limit key
+	limit atomic.Int64 // Rate limit in bytes per second (unlimited when <= 0)
+	lease atomic.Int64 // Lease size in bytes (automatic when <= 0)
+
+	lmu   sync.Mutex    // Mutex guarding the lease state
+	avail int64         // Number of leased bytes that have not been used
+	until time.Time     // Lease expiration time
+	retry time.Time     // Earliest time of the next lease request
+	err   error         // Error of the most recent lease request
+	fails int           // Number of consecutive failed lease requests
+	fetch chan struct{} // Channel closed when the lease request in progress ends
+}
+
+const (
+	leaseBackoffMin = 100 * time.Millisecond // Retry delay after a Backend error
+	leaseBackoffMax = 10 * time.Second       // Maximum retry delay
+	leaseTimeout    = 10 * time.Second       // Maximum duration of a lease request
+)
+
+// NewSharedLimit returns a SharedLimit that restricts the combined rate of all
+// processes using limit key of Backend b to limit bytes per second. The limit
+// should be the same in all processes. opts are passed to the Monitor
+// constructor.
+func NewSharedLimit(b Backend, key string, limit int64, opts ...Option) *SharedLimit {
+	s := &SharedLimit{Monitor: New(0, 0, opts...), b: b, key: key}
+	s.limit.Store(limit)
+	return s
+}
+
+// WithShared makes the new Monitor draw its allowances from SharedLimit s. All
+// Limit calls are further restricted by the bytes leased from the shared limit,
+// and all transfers are included in its statistics.
+func WithShared(s *SharedLimit) Option {
+	return func(m *Monitor) {
+		m.shared = s
+	}
+}
+
+// SetLimit changes the rate limit to new bytes per second and returns the
+// previous setting.
+func (s *SharedLimit) SetLimit(new int64) (old int64) {
+	return s.limit.Swap(new)
+}
+
+// SetLease changes the number of bytes that are requested from the Backend at a
+// time and returns the previous setting. The default (new <= 0) is a tenth of
+// the rate limit, which is one sample worth of bytes at the default sampling
+// rate.
+func (s *SharedLimit) SetLease(new int64) (old int64) {
+	return s.lease.Swap(new)
+}
+
+// limitContext returns the number of bytes (0 <= n <= want) that may be
+// transferred immediately without exceeding the shared limit. The bytes remain
+// in the lease until they are charged by Monitor.update. If block == true, the
+// call waits until the Backend allows at least one more byte to be leased or
+// ctx is done.
+func (s *SharedLimit) limitContext(ctx context.Context, want int, block bool) (int, error) {
+	rate := s.limit.Load()
+	if rate < 1 {
+		return want, nil
+	}
+	for {
+		now := s.clk.Now()
+		s.lmu.Lock()
+		if s.avail > 0 && now.Before(s.until) {
+			n := int64(want)
+			if n > s.avail {
+				n = s.avail
+			}
+			s.lmu.Unlock()
+			return int(n), nil
+		}
+		if wait := s.retry.Sub(now); wait > 0 {
+			err := s.err
+			s.lmu.Unlock()
+			if err != nil || !block {
+				return 0, err
+			}
+			timer := s.clk.After(wait)
+			select {
+			case <-timer:
+			case <-ctx.Done():
+				stopTimer(s.clk, timer)
+				return 0, ctx.Err()
+			}
+			continue
+		}
+		fetch := s.fetch
+		if fetch == nil {
+			fetch = make(chan struct{})
+			s.fetch = fetch
+			s.lmu.Unlock()
+			if !block {
+				go s.renew(context.Background(), rate, fetch)
+				return 0, nil
+			}
+			if err := s.renew(ctx, rate, fetch); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		s.lmu.Unlock()
+		if !block {
+			return 0, nil
+		}
+		select {
+		case <-fetch:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// charge removes n transferred bytes from the lease and records them in the
+// aggregate statistics.
+func (s *SharedLimit) charge(n int) {
+	s.Update(n)
+	if s.limit.Load() < 1 {
+		return
+	}
+	s.lmu.Lock()
+	s.avail -= int64(n)
+	s.lmu.Unlock()
+}
+
+// renew requests a new lease from the Backend and closes fetch when done. The
+// request is canceled after leaseTimeout, which is measured in real time, so
+// that a stalled Backend does not block the waiting Limit calls indefinitely.
+// If the request fails, the next one is delayed by an exponential backoff,
+// unless the failure was caused by ctx.
+func (s *SharedLimit) renew(ctx context.Context, rate int64, fetch chan struct{}) error {
+	n := s.lease.Load()
+	if n <= 0 {
+		if n = rate / 10; n < 1 {
+			n = 1
+		}
+	}
+	rctx, cancel := context.WithTimeout(ctx, leaseTimeout)
+	granted, ttl, err := s.b.Reserve(rctx, s.key, n, rate)
+	cancel()
+	now := s.clk.Now()
+	s.lmu.Lock()
+	switch {
+	case err == nil:
+		s.err, s.fails = nil, 0
+		if granted > 0 {
+			if s.avail > 0 {
+				s.avail = 0 // Unused bytes of the expired lease
+			}
+			s.avail, s.until = s.avail+granted, now.Add(ttl)
+		} else {
+			s.retry = now.Add(ttl)
+		}
+	case ctx.Err() == nil:
+		backoff := leaseBackoffMax
+		if s.fails < 16 {
+			if backoff = leaseBackoffMin << s.fails; backoff > leaseBackoffMax {
+				backoff = leaseBackoffMax
+			}
+		}
+		s.err, s.retry = err, now.Add(backoff)
+		s.fails++
+	}
+	s.fetch = nil
+	s.lmu.Unlock()
+	close(fetch)
+	return err
+}
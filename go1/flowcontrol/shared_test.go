@@ -0,0 +1,191 @@
+package flowcontrol
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countBackend counts the Reserve calls of a Backend.
+type countBackend struct {
+	Backend
+	n atomic.Int64
+}
+
+func (b *countBackend) Reserve(ctx context.Context, key string, n, rate int64) (int64, time.Duration, error) {
+	b.n.Add(1)
+	return b.Backend.Reserve(ctx, key, n, rate)
+}
+
+// deadlineBackend fails requests without a deadline.
+type deadlineBackend struct{ Backend }
+
+func (b deadlineBackend) Reserve(ctx context.Context, key string, n, rate int64) (int64, time.Duration, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		return 0, 0, errors.New("no deadline")
+	}
+	return b.Backend.Reserve(ctx, key, n, rate)
+}
+
+func TestMemBackend(t *testing.T) {
+	c := NewManualClock(clockStart)
+	b := NewMemBackend(time.Second, c)
+	ctx := context.Background()
+
+	c.Add(_100ms)
+	tests := []struct {
+		key           string
+		n, rate, want int64
+	}{
+		{"a", 600, 1000, 600},
+		{"a", 600, 1000, 400},
+		{"a", 600, 1000, 0},
+		{"b", 600, 1000, 600},
+		{"c", 1, 0, 1},
+	}
+	for i, test := range tests {
+		n, ttl, err := b.Reserve(ctx, test.key, test.n, test.rate)
+		if n != test.want || ttl != time.Second-_100ms || err != nil {
+			t.Errorf("b.Reserve() #%v expected %v (900ms, <nil>); got %v (%v, %v)",
+				i, test.want, n, ttl, err)
+		}
+	}
+
+	// New window
+	c.Add(time.Second)
+	if n, ttl, _ := b.Reserve(ctx, "a", 600, 1000); n != 600 || ttl != time.Second-_100ms {
+		t.Errorf("b.Reserve() expected 600 (900ms); got %v (%v)", n, ttl)
+	}
+}
+
+// waitLease waits for the lease request of s in progress, if any.
+func waitLease(s *SharedLimit) {
+	s.lmu.Lock()
+	fetch := s.fetch
+	s.lmu.Unlock()
+	if fetch != nil {
+		<-fetch
+	}
+}
+
+// writeShared performs non-blocking writes of the remaining bytes of b to w
+// until s denies a lease, waiting for the background lease requests of s in
+// between, and returns the total number of bytes written.
+func writeShared(w *Writer, s *SharedLimit, b []byte) (n int) {
+	for i := 0; i < 20 && n < len(b); i++ {
+		m, _ := w.Write(b[n:])
+		n += m
+		waitLease(s)
+	}
+	return
+}
+
+func TestSharedLimit(t *testing.T) {
+	c := NewManualClock(clockStart)
+	b := &countBackend{Backend: NewMemBackend(time.Second, c)}
+	s1 := NewSharedLimit(b, "fleet", 1000, WithClock(c))
+	s2 := NewSharedLimit(b, "fleet", 1000, WithClock(c))
+	s1.SetLease(300)
+	w1 := NewWriter(io.Discard, 0, WithClock(c), WithShared(s1))
+	w2 := NewWriter(io.Discard, 0, WithClock(c), WithShared(s2))
+
+	// Non-blocking writes do not wait for the lease
+	w1.SetBlocking(false)
+	if n, err := w1.Write(make([]byte, 10)); n != 0 || err != ErrLimit {
+		t.Fatalf("w1.Write() expected 0 (%v); got %v (%v)", ErrLimit, n, err)
+	}
+	waitLease(s1)
+
+	// Bytes are charged when they are transferred
+	for i := 0; i < 2; i++ {
+		if n := w1.Limit(1000, 0, false); n != 300 {
+			t.Fatalf("w1.Limit() #%v expected 300; got %v", i, n)
+		}
+	}
+
+	// Small writes are served from the local lease
+	for i := 0; i < 60; i++ {
+		n, err := w1.Write(make([]byte, 10))
+		if n == 0 && err == ErrLimit && i == 30 {
+			waitLease(s1)
+			n, err = w1.Write(make([]byte, 10))
+		}
+		if n != 10 || err != nil {
+			t.Fatalf("w1.Write() #%v expected 10 (<nil>); got %v (%v)", i, n, err)
+		}
+	}
+	if n := b.n.Load(); n != 2 {
+		t.Fatalf("w1 expected 2 Reserve calls; got %v", n)
+	}
+
+	// Processes share the allowance of each window
+	w2.SetBlocking(false)
+	if n := writeShared(w2, s2, make([]byte, 500)); n != 400 {
+		t.Fatalf("w2.Write() expected 400; got %v", n)
+	}
+	if n, err := w2.Write(make([]byte, 500)); n != 0 || err != ErrLimit {
+		t.Fatalf("w2.Write() expected 0 (%v); got %v (%v)", ErrLimit, n, err)
+	}
+	if n := b.n.Load(); n != 7 {
+		t.Fatalf("w2 expected to stop requesting leases until the next window; got %v calls", n)
+	}
+
+	// Blocking writes wait for the next window
+	w2.SetBlocking(true)
+	done := make(chan int)
+	go func() {
+		n, _ := w2.Write(make([]byte, 150))
+		done <- n
+	}()
+	c.BlockUntil(1)
+	c.Add(time.Second)
+	if n := <-done; n != 150 {
+		t.Fatalf("w2.Write() expected 150; got %v", n)
+	}
+
+	// Unused leases expire at the end of the window
+	c.Add(time.Second)
+	if n := writeShared(w1, s1, make([]byte, 2000)); n != 1000 {
+		t.Fatalf("w1.Write() expected 1000; got %v", n)
+	}
+	w2.SetBlocking(false)
+	if n := writeShared(w2, s2, make([]byte, 10)); n != 0 {
+		t.Fatalf("w2.Write() expected 0 after the lease expired; got %v", n)
+	}
+
+	// Unlimited
+	s2.SetLimit(0)
+	if n, err := w2.Write(make([]byte, 5000)); n != 5000 || err != nil {
+		t.Fatalf("w2.Write() expected 5000 (<nil>); got %v (%v)", n, err)
+	}
+}
+
+func TestSharedLimitBackoff(t *testing.T) {
+	c := NewManualClock(clockStart)
+	b := &countBackend{Backend: errBackend{}}
+	s := NewSharedLimit(b, "fleet", 1000, WithClock(c))
+	ctx := context.Background()
+
+	// Failed requests are retried after an exponential backoff
+	for i, want := range []int64{1, 2, 2, 3, 3} {
+		if _, err := s.limitContext(ctx, 10, true); err == nil {
+			t.Fatalf("s.limitContext() #%v expected an error", i)
+		}
+		if n := b.n.Load(); n != want {
+			t.Fatalf("s.limitContext() #%v expected %v Reserve calls; got %v", i, want, n)
+		}
+		c.Add(_100ms)
+	}
+
+	// Lease requests are bounded even if the caller's context is not
+	s = NewSharedLimit(deadlineBackend{NewMemBackend(time.Second, c)}, "fleet", 1000, WithClock(c))
+	if n, err := s.limitContext(ctx, 10, false); n != 0 || err != nil {
+		t.Fatalf("s.limitContext() expected 0 (<nil>); got %v (%v)", n, err)
+	}
+	if n, err := s.limitContext(ctx, 10, true); n != 10 || err != nil {
+		t.Fatalf("s.limitContext() expected 10 (<nil>); got %v (%v)", n, err)
+	}
+}
@@ -0,0 +1,119 @@
+package flowcontrol
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// ErrSnapshot is returned by Snapshot.UnmarshalBinary and Monitor.Restore when
+// the snapshot data is invalid.
+var ErrSnapshot = errors.New("flowcontrol: invalid Monitor snapshot")
+
+// snapshotVersion is the version of the binary snapshot encoding.
+const snapshotVersion = 1
+
+// snapshotLen is the length of the binary snapshot encoding.
+const snapshotLen = 1 + 7*8
+
+// Snapshot is the persistent state of a Monitor, which allows a transfer to be
+// resumed after a restart. It contains the start time, byte and sample counts,
+// current and peak transfer rates, and the transfer size and offset. It does
+// not contain the rate limit statistics or any Monitor options. A Snapshot may
+// be encoded with MarshalBinary or as JSON.
+type Snapshot struct {
+	Start    time.Time `json:"start"`     // Transfer start time
+	Bytes    int64     `json:"bytes"`     // Total number of bytes transferred
+	Samples  int64     `json:"samples"`   // Total number of samples taken
+	Size     int64     `json:"size"`      // Transfer size
+	Offset   int64     `json:"offset"`    // Transfer offset
+	CurRate  float64   `json:"cur_rate"`  // EMA of the transfer rate
+	PeakRate float64   `json:"peak_rate"` // Peak transfer rate
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (s Snapshot) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 1, snapshotLen)
+	b[0] = snapshotVersion
+	for _, v := range [...]uint64{
+		uint64(s.Start.UnixNano()),
+		uint64(s.Bytes),
+		uint64(s.Samples),
+		uint64(s.Size),
+		uint64(s.Offset),
+		math.Float64bits(s.CurRate),
+		math.Float64bits(s.PeakRate),
+	} {
+		b = binary.BigEndian.AppendUint64(b, v)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. It decodes a snapshot
+// encoded by MarshalBinary.
+func (s *Snapshot) UnmarshalBinary(b []byte) error {
+	if len(b) != snapshotLen || b[0] != snapshotVersion {
+		return ErrSnapshot
+	}
+	var v [7]uint64
+	for i := range v {
+		v[i] = binary.BigEndian.Uint64(b[1+8*i:])
+	}
+	*s = Snapshot{
+		Start:    time.Unix(0, int64(v[0])),
+		Bytes:    int64(v[1]),
+		Samples:  int64(v[2]),
+		Size:     int64(v[3]),
+		Offset:   int64(v[4]),
+		CurRate:  math.Float64frombits(v[5]),
+		PeakRate: math.Float64frombits(v[6]),
+	}
+	return nil
+}
+
+// Snapshot returns the current persistent state of m.
+func (m *Monitor) Snapshot() Snapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.update(0)
+	return Snapshot{
+		Start:    clockToTime(m.start),
+		Bytes:    m.bytes + m.sBytes,
+		Samples:  m.samples,
+		Size:     m.tBytes,
+		Offset:   m.tOff,
+		CurRate:  m.rEMA,
+		PeakRate: m.rPeak,
+	}
+}
+
+// Restore replaces the statistics of m with those in snapshot s. The restored
+// Monitor is active and its Duration includes the time between the snapshot
+// and the restore. It returns ErrSnapshot if s is invalid.
+func (m *Monitor) Restore(s *Snapshot) error {
+	if s.Bytes < 0 || s.Samples < 0 || s.Size < 0 ||
+		s.Offset < 0 || !(s.CurRate >= 0) || !(s.PeakRate >= 0) {
+		return ErrSnapshot
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.clock()
+	m.active = true
+	m.start = now
+	if !s.Start.IsZero() && s.Start.Before(clockToTime(now)) {
+		m.start = timeToClock(s.Start, m.res)
+	}
+	m.bytes = s.Bytes
+	m.samples = s.Samples
+	m.rSample = 0
+	m.rEMA = s.CurRate
+	m.rPeak = s.PeakRate
+	m.sBytes = 0
+	m.sLast = now
+	m.tBytes = s.Size
+	m.tOff = s.Offset
+	m.tLast = now
+	m.bLast = now
+	return nil
+}
@@ -0,0 +1,81 @@
+package flowcontrol
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	c := NewManualClock(clockStart)
+	m := New(_100ms, time.Second, WithClock(c))
+	m.SetTransferSize(1000)
+	m.SetTransferOffset(200)
+	m.Update(100)
+	c.Add(_100ms)
+	m.Update(50)
+	c.Add(_100ms)
+	want := m.Status()
+
+	b, err := m.Snapshot().MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() unexpected error: %v", err)
+	}
+	j, err := json.Marshal(m.Snapshot())
+	if err != nil {
+		t.Fatalf("json.Marshal() unexpected error: %v", err)
+	}
+
+	// Restored statistics cover the time between the snapshot and the restore
+	c.Add(time.Second)
+	for i, decode := range []func(s *Snapshot) error{
+		func(s *Snapshot) error { return s.UnmarshalBinary(b) },
+		func(s *Snapshot) error { return json.Unmarshal(j, s) },
+	} {
+		var snap Snapshot
+		if err := decode(&snap); err != nil {
+			t.Fatalf("decode(%v) unexpected error: %v", i, err)
+		}
+		m := New(_100ms, time.Second, WithClock(c))
+		if err := m.Restore(&snap); err != nil {
+			t.Fatalf("restore(%v) unexpected error: %v", i, err)
+		}
+		s := m.Status()
+		if !s.Active || !s.Start.Equal(want.Start) || s.Duration != c.Now().Sub(want.Start) ||
+			s.Bytes != 150 || s.Samples != want.Samples || s.PeakRate != want.PeakRate ||
+			s.BytesRem != 650 || s.Progress != 35000 {
+			t.Errorf("restore(%v) expected %v; got %v", i, want, s)
+		}
+		m.Update(150)
+		c.Add(_100ms)
+		if s = m.Status(); s.Bytes != 300 || s.BytesRem != 500 || s.Progress != 50000 {
+			t.Errorf("restore(%v) expected 300 bytes at 50%%; got %v", i, s)
+		}
+	}
+
+	// Bytes of the current sample are included
+	m = New(_100ms, time.Second, WithClock(c))
+	m.SetTransferSize(1000)
+	m.Update(300)
+	snap := m.Snapshot()
+	if snap.Bytes != 300 {
+		t.Errorf("m.Snapshot().Bytes expected 300 in the middle of a sample; got %v", snap.Bytes)
+	}
+	r := New(_100ms, time.Second, WithClock(c))
+	if r.Restore(&snap); r.Status().BytesRem != 700 {
+		t.Errorf("r.Status().BytesRem expected 700; got %v", r.Status().BytesRem)
+	}
+
+	// Invalid snapshots
+	if err := snap.UnmarshalBinary(b[1:]); err != ErrSnapshot {
+		t.Errorf("UnmarshalBinary(b[1:]) expected ErrSnapshot; got %v", err)
+	}
+	if err := New(0, 0).Restore(&Snapshot{Bytes: -1}); err != ErrSnapshot {
+		t.Errorf("Restore() expected ErrSnapshot; got %v", err)
+	}
+
+	// Types that embed a Monitor are not encoded as snapshots
+	if _, ok := any(NewWriter(nil, 0)).(json.Marshaler); ok {
+		t.Errorf("Writer unexpectedly implements json.Marshaler")
+	}
+}
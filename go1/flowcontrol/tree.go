@@ -0,0 +1,145 @@
+package flowcontrol
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Node is an element in a hierarchy of nested rate limits, such as a global
+// limit that contains per-tenant limits, which contain per-user limits. Each
+// node has a name, its own rate limit, and a Monitor that collects the
+// aggregate statistics of all transfers in its subtree. A Monitor that is
+// attached to a node with WithParent is restricted by the limits of that node
+// and all of its ancestors, with the smallest allowance taking precedence.
+type Node struct {
+	*Monitor // Aggregate statistics and flow control
+
+	name   string       // Node name
+	parent *Node        // Parent node (nil for the root)
+	limit  atomic.Int64 // Rate limit in bytes per second (unlimited when <= 0)
+	opts   []Option     // Monitor options for child nodes
+
+	mu       sync.Mutex       // Mutex guarding access to children
+	children map[string]*Node // Child nodes by name
+}
+
+// NewTree creates the root node of a new hierarchy with the given name and
+// rate limit of limit bytes per second. opts are passed to the Monitor
+// constructor of each node in the hierarchy.
+func NewTree(name string, limit int64, opts ...Option) *Node {
+	return newNode(name, nil, limit, opts)
+}
+
+// newNode creates a new node.
+func newNode(name string, parent *Node, limit int64, opts []Option) *Node {
+	n := &Node{name: name, parent: parent, opts: opts}
+	if parent != nil {
+		opts = append(opts[:len(opts):len(opts)], WithParent(parent))
+	}
+	n.Monitor = New(0, 0, opts...)
+	n.limit.Store(limit)
+	return n
+}
+
+// WithParent makes the new Monitor a descendant of node n. All Limit calls are
+// further restricted by the limits of n and its ancestors, and all transfers
+// are included in their statistics.
+func WithParent(n *Node) Option {
+	return func(m *Monitor) {
+		m.parent = n
+	}
+}
+
+// Name returns the name of the node.
+func (n *Node) Name() string {
+	return n.name
+}
+
+// Path returns the slash-separated names of all nodes from the root to n.
+func (n *Node) Path() string {
+	if n.parent == nil {
+		return n.name
+	}
+	return n.parent.Path() + "/" + n.name
+}
+
+// Child returns the child node with the given name. If there is no such child,
+// a new one is created with a rate limit of limit bytes per second. The limit
+// of an existing child is not changed.
+func (n *Node) Child(name string, limit int64) *Node {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c := n.children[name]
+	if c == nil {
+		if n.children == nil {
+			n.children = make(map[string]*Node)
+		}
+		c = newNode(name, n, limit, n.opts)
+		n.children[name] = c
+	}
+	return c
+}
+
+// Lookup returns the descendant of n with the given slash-separated path
+// relative to n, or nil if there is no such node. An empty path returns n.
+func (n *Node) Lookup(path string) *Node {
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		n.mu.Lock()
+		c := n.children[name]
+		n.mu.Unlock()
+		if n = c; n == nil {
+			break
+		}
+	}
+	return n
+}
+
+// Walk calls fn for n and all of its descendants in depth-first order. Children
+// are visited in order of their names.
+func (n *Node) Walk(fn func(n *Node)) {
+	fn(n)
+	n.mu.Lock()
+	children := make([]*Node, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	n.mu.Unlock()
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].name < children[j].name
+	})
+	for _, c := range children {
+		c.Walk(fn)
+	}
+}
+
+// Remove removes n and all of its descendants from the hierarchy and marks
+// their transfers as finished. Monitors that are still attached to any of the
+// removed nodes are no longer restricted by the enclosing limits.
+func (n *Node) Remove() {
+	if p := n.parent; p != nil {
+		p.mu.Lock()
+		if p.children[n.name] == n {
+			delete(p.children, n.name)
+		}
+		p.mu.Unlock()
+	}
+	n.Walk(func(n *Node) { n.Done() })
+}
+
+// SetLimit changes the rate limit of the node to new bytes per second and
+// returns the previous setting.
+func (n *Node) SetLimit(new int64) (old int64) {
+	return n.limit.Swap(new)
+}
+
+// limitContext returns the number of bytes (0 <= n <= want) that may be
+// transferred immediately without exceeding the limits of n and its ancestors.
+func (n *Node) limitContext(ctx context.Context, want int, block bool) (int, error) {
+	return n.LimitContext(ctx, want, n.limit.Load(), block)
+}
@@ -0,0 +1,65 @@
+package flowcontrol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTree(t *testing.T) {
+	b := make([]byte, 100)
+	c := NewManualClock(clockStart)
+	root := NewTree("global", 1000, WithClock(c))
+	user := root.Child("tenant", 500).Child("user", 200)
+	if n := root.Child("tenant", 0).Child("user", 0); n != user {
+		t.Fatalf("root.Child() returned a new node for an existing path")
+	}
+	if path := user.Path(); path != "global/tenant/user" {
+		t.Fatalf("user.Path() expected global/tenant/user; got %v", path)
+	}
+	w1 := NewWriter(&bytes.Buffer{}, 0, WithClock(c), WithParent(user))
+	w2 := NewWriter(&bytes.Buffer{}, 100, WithClock(c), WithParent(user))
+	w1.SetBlocking(false)
+	w2.SetBlocking(false)
+
+	// Smallest allowance wins
+	if n, err := w2.Write(b); n != 10 || err != ErrLimit {
+		t.Fatalf("w2.Write(b) expected 10 (ErrLimit); got %v (%v)", n, err)
+	}
+	if n, err := w1.Write(b); n != 10 || err != ErrLimit {
+		t.Fatalf("w1.Write(b) expected 10 (ErrLimit); got %v (%v)", n, err)
+	}
+	root.Lookup("tenant").SetLimit(50)
+	c.Add(_100ms)
+	if n, err := w1.Write(b); n != 5 || err != ErrLimit {
+		t.Fatalf("w1.Write(b) expected 5 (ErrLimit); got %v (%v)", n, err)
+	}
+
+	// Statistics are collected by all enclosing nodes
+	c.Add(_100ms)
+	var paths []string
+	var counts []int64
+	root.Walk(func(n *Node) {
+		paths = append(paths, n.Path())
+		counts = append(counts, n.Status().Bytes)
+	})
+	if len(paths) != 3 || paths[2] != "global/tenant/user" {
+		t.Fatalf("root.Walk() visited %v", paths)
+	}
+	for i, n := range counts {
+		if n != 25 {
+			t.Errorf("%v Status().Bytes expected 25; got %v", paths[i], n)
+		}
+	}
+	if n := root.Lookup("tenant/missing"); n != nil {
+		t.Fatalf("root.Lookup(tenant/missing) expected nil; got %v", n.Path())
+	}
+
+	// Removed nodes no longer restrict their descendants
+	root.Lookup("/tenant/").Remove()
+	if n := root.Lookup("tenant/user"); n != nil {
+		t.Fatalf("root.Lookup(tenant/user) expected nil after Remove")
+	}
+	if n, err := w1.Write(b); n != 100 || err != nil {
+		t.Fatalf("w1.Write(b) expected 100 (<nil>); got %v (%v)", n, err)
+	}
+}
@@ -0,0 +1,211 @@
+package flowcontrol
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Size is a number of bytes. It can be parsed from and formatted as a string
+// with SI or IEC prefixes in bits or bytes, such as "1.5GB", "512KiB", or
+// "10Mbit". A string without a unit is a number of bytes.
+type Size int64
+
+// Rate is a transfer rate in bytes per second. It uses the same format as Size
+// with an optional "/s" or "ps" suffix, such as "10MiB/s" or "512kbit/s".
+type Rate int64
+
+// Units selects the prefixes and base unit used by FormatUnits.
+type Units int
+
+const (
+	IEC     Units = iota // Binary prefixes and bytes (KiB, MiB, ...)
+	SI                   // Decimal prefixes and bytes (kB, MB, ...)
+	IECBits              // Binary prefixes and bits (Kibit, Mibit, ...)
+	SIBits               // Decimal prefixes and bits (kbit, Mbit, ...)
+)
+
+// Unit prefixes in increasing order.
+var (
+	siPrefixes  = [...]string{"", "k", "M", "G", "T", "P", "E"}
+	iecPrefixes = [...]string{"", "Ki", "Mi", "Gi", "Ti", "Pi", "Ei"}
+)
+
+// ParseSize parses a size string, such as "1.5GB" or "512KiB". Decimal
+// prefixes are case-insensitive, so "kB" and "KB" both mean 1000 bytes. Bits
+// are specified as "b", "bit", or "bits", and are rounded to the nearest byte.
+func ParseSize(s string) (Size, error) {
+	n, err := parseUnits(s, false)
+	return Size(n), err
+}
+
+// ParseRate parses a rate string, such as "10MiB/s" or "512kbit/s", in the
+// format described by ParseSize.
+func ParseRate(s string) (Rate, error) {
+	n, err := parseUnits(s, true)
+	return Rate(n), err
+}
+
+// String returns s using the largest prefix that represents it exactly.
+func (s Size) String() string {
+	return formatExact(int64(s))
+}
+
+// FormatUnits returns s using the largest prefix of u that keeps the number at
+// or above 1, with prec digits after the decimal point (-1 for the minimum
+// number of digits necessary to represent the value exactly).
+func (s Size) FormatUnits(u Units, prec int) string {
+	return formatUnits(float64(s), u, prec)
+}
+
+// Set implements flag.Value.
+func (s *Size) Set(v string) error {
+	n, err := ParseSize(v)
+	if err == nil {
+		*s = n
+	}
+	return err
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Size) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *Size) UnmarshalText(b []byte) error {
+	return s.Set(string(b))
+}
+
+// String returns r using the largest prefix that represents it exactly.
+func (r Rate) String() string {
+	return formatExact(int64(r)) + "/s"
+}
+
+// FormatUnits returns r in the same format as Size.FormatUnits with a "/s"
+// suffix.
+func (r Rate) FormatUnits(u Units, prec int) string {
+	return formatUnits(float64(r), u, prec) + "/s"
+}
+
+// Set implements flag.Value.
+func (r *Rate) Set(v string) error {
+	n, err := ParseRate(v)
+	if err == nil {
+		*r = n
+	}
+	return err
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (r Rate) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (r *Rate) UnmarshalText(b []byte) error {
+	return r.Set(string(b))
+}
+
+// parseUnits parses a size or rate string and returns the number of bytes.
+func parseUnits(s string, rate bool) (int64, error) {
+	// Split the number and the unit
+	t := strings.TrimSpace(s)
+	i := 0
+	for i < len(t) && (t[i] == '.' || ('0' <= t[i] && t[i] <= '9')) {
+		i++
+	}
+	v, err := strconv.ParseFloat(t[:i], 64)
+	if err != nil {
+		return 0, unitsError(s, rate)
+	}
+	u := strings.TrimSpace(t[i:])
+	if rate {
+		if strings.HasSuffix(u, "/s") {
+			u = u[:len(u)-2]
+		} else if strings.HasSuffix(u, "ps") {
+			u = u[:len(u)-2]
+		}
+	}
+
+	// Base unit
+	bits := false
+	for _, b := range [...]string{"bits", "bit", "b"} {
+		if strings.HasSuffix(u, b) {
+			u, bits = u[:len(u)-len(b)], true
+			break
+		}
+	}
+	if !bits {
+		u = strings.TrimSuffix(u, "B")
+	}
+
+	// Prefix
+	if u != "" {
+		base := 1000.0
+		if len(u) == 2 && u[1] == 'i' {
+			base = 1024
+		} else if len(u) != 1 {
+			return 0, unitsError(s, rate)
+		}
+		p := strings.IndexByte("kmgtpe", u[0]|0x20) // ASCII lower case
+		if p < 0 {
+			return 0, unitsError(s, rate)
+		}
+		v *= math.Pow(base, float64(p+1))
+	}
+	if bits {
+		v /= 8
+	}
+	if v = math.Round(v); v >= math.MaxInt64 {
+		return 0, unitsError(s, rate)
+	}
+	return int64(v), nil
+}
+
+// unitsError returns the error for an invalid size or rate string s.
+func unitsError(s string, rate bool) error {
+	if rate {
+		return errors.New("flowcontrol: invalid rate " + strconv.Quote(s))
+	}
+	return errors.New("flowcontrol: invalid size " + strconv.Quote(s))
+}
+
+// formatExact returns n as a number of bytes using the largest SI or IEC prefix
+// that represents it exactly.
+func formatExact(n int64) string {
+	v, p := n, ""
+	if n != 0 {
+		// Multipliers are checked in increasing order: 1000, 1024, 1000^2, ...
+		si, iec := int64(1), int64(1)
+		for i := 1; i < len(siPrefixes); i++ {
+			if si *= 1000; n%si == 0 {
+				v, p = n/si, siPrefixes[i]
+			}
+			if iec *= 1024; n%iec == 0 {
+				v, p = n/iec, iecPrefixes[i]
+			}
+		}
+	}
+	return strconv.FormatInt(v, 10) + p + "B"
+}
+
+// formatUnits returns n bytes in the given units.
+func formatUnits(n float64, u Units, prec int) string {
+	base, prefixes, unit := 1024.0, iecPrefixes, "B"
+	if u == SI || u == SIBits {
+		base, prefixes = 1000, siPrefixes
+	}
+	if u == IECBits || u == SIBits {
+		n, unit = n*8, "bit"
+	}
+	i := 0
+	for ; i < len(prefixes)-1 && math.Abs(n) >= base; i++ {
+		n /= base
+	}
+	if i == 0 {
+		prec = 0
+	}
+	return strconv.FormatFloat(n, 'f', prec, 64) + prefixes[i] + unit
+}
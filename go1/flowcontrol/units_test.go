@@ -0,0 +1,125 @@
+package flowcontrol
+
+import (
+	"encoding/json"
+	"flag"
+	"testing"
+)
+
+func TestParseUnits(t *testing.T) {
+	sizes := map[string]Size{
+		"0":        0,
+		"100":      100,
+		"1.5GB":    1500000000,
+		"1.5 GB":   1500000000,
+		"512KiB":   512 << 10,
+		"512Kib":   64 << 10,
+		"10kB":     10000,
+		"10KB":     10000,
+		"10k":      10000,
+		"10Mbit":   1250000,
+		"10Mb":     1250000,
+		"12bits":   2,
+		"1Ei":      1 << 60,
+		" 2.5 MiB": 2621440,
+	}
+	for s, want := range sizes {
+		if got, err := ParseSize(s); got != want || err != nil {
+			t.Errorf("ParseSize(%q) expected %v (<nil>); got %v (%v)", s, want, got, err)
+		}
+	}
+	rates := map[string]Rate{
+		"10MiB/s":   10 << 20,
+		"512kbit/s": 64000,
+		"100Mbps":   12500000,
+		"1MBps":     1000000,
+		"10 KiB":    10240,
+		"1000":      1000,
+	}
+	for s, want := range rates {
+		if got, err := ParseRate(s); got != want || err != nil {
+			t.Errorf("ParseRate(%q) expected %v (<nil>); got %v (%v)", s, want, got, err)
+		}
+	}
+	for _, s := range []string{"", "MB", "-1", "1x", "1KiiB", "1 MB/s", "10EiB", "1e3"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) expected an error", s)
+		}
+	}
+	if _, err := ParseRate("1MB/m"); err == nil {
+		t.Errorf("ParseRate(%q) expected an error", "1MB/m")
+	}
+}
+
+func TestFormatUnits(t *testing.T) {
+	exact := map[Size]string{
+		0:          "0B",
+		999:        "999B",
+		1000:       "1kB",
+		1024:       "1KiB",
+		1024000:    "1000KiB",
+		1500000000: "1500MB",
+		3 << 30:    "3GiB",
+	}
+	for n, want := range exact {
+		if got := n.String(); got != want {
+			t.Errorf("Size(%d).String() expected %q; got %q", int64(n), want, got)
+		}
+		if got, err := ParseSize(want); got != n || err != nil {
+			t.Errorf("ParseSize(%q) expected %d (<nil>); got %v (%v)", want, int64(n), got, err)
+		}
+	}
+	if got := Rate(64000).String(); got != "64kB/s" {
+		t.Errorf("Rate(64000).String() expected %q; got %q", "64kB/s", got)
+	}
+	tests := []struct {
+		n    int64
+		u    Units
+		prec int
+		want string
+	}{
+		{1023, IEC, 1, "1023B"},
+		{12900000, IEC, 1, "12.3MiB"},
+		{12900000, SI, 1, "12.9MB"},
+		{64000, SIBits, -1, "512kbit"},
+		{1 << 20, IECBits, 0, "8Mibit"},
+		{1<<63 - 1, IEC, 1, "8.0EiB"},
+	}
+	for _, test := range tests {
+		if got := Size(test.n).FormatUnits(test.u, test.prec); got != test.want {
+			t.Errorf("Size(%d).FormatUnits(%v, %v) expected %q; got %q",
+				test.n, test.u, test.prec, test.want, got)
+		}
+		if got := Rate(test.n).FormatUnits(test.u, test.prec); got != test.want+"/s" {
+			t.Errorf("Rate(%d).FormatUnits(%v, %v) expected %q; got %q",
+				test.n, test.u, test.prec, test.want+"/s", got)
+		}
+	}
+}
+
+func TestUnitsFlag(t *testing.T) {
+	var cfg struct {
+		Limit Rate `json:"limit"`
+		Quota Size `json:"quota"`
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&cfg.Limit, "limit", "rate limit")
+	fs.Var(&cfg.Quota, "quota", "transfer quota")
+	if err := fs.Parse([]string{"-limit", "10MiB/s", "-quota", "1.5GB"}); err != nil {
+		t.Fatalf("fs.Parse() unexpected error: %v", err)
+	}
+	if cfg.Limit != 10<<20 || cfg.Quota != 1500000000 {
+		t.Fatalf("fs.Parse() expected 10MiB/s and 1.5GB; got %v and %v", cfg.Limit, cfg.Quota)
+	}
+	b, err := json.Marshal(&cfg)
+	if want := `{"limit":"10MiB/s","quota":"1500MB"}`; string(b) != want || err != nil {
+		t.Fatalf("json.Marshal() expected %s (<nil>); got %s (%v)", want, b, err)
+	}
+	if err := json.Unmarshal([]byte(`{"limit":"512kbit/s","quota":"2GiB"}`), &cfg); err != nil {
+		t.Fatalf("json.Unmarshal() unexpected error: %v", err)
+	}
+	if cfg.Limit != 64000 || cfg.Quota != 2<<30 {
+		t.Fatalf("json.Unmarshal() expected 64000 and %v; got %v and %v",
+			2<<30, int64(cfg.Limit), int64(cfg.Quota))
+	}
+}
@@ -10,26 +10,27 @@ import (
 	"time"
 )
 
-// clockRate is the resolution and precision of clock().
+// clockRate is the default resolution and precision of the Monitor clock.
 const clockRate = 20 * time.Millisecond
 
 // czero is the process start time rounded down to the nearest clockRate
 // increment.
 var czero = time.Duration(time.Now().UnixNano()) / clockRate * clockRate
 
-// clock returns a low resolution timestamp relative to the process start time.
-func clock() time.Duration {
-	return time.Duration(time.Now().UnixNano())/clockRate*clockRate - czero
+// timeToClock converts an absolute time.Time value to a timestamp with the
+// given resolution relative to the process start time.
+func timeToClock(t time.Time, res time.Duration) time.Duration {
+	return time.Duration(t.UnixNano())/res*res - czero
 }
 
-// clockToTime converts a clock() timestamp to an absolute time.Time value.
+// clockToTime converts a timeToClock() timestamp to an absolute time.Time value.
 func clockToTime(c time.Duration) time.Time {
 	return time.Unix(0, int64(czero+c))
 }
 
-// clockRound returns d rounded to the nearest clockRate increment.
-func clockRound(d time.Duration) time.Duration {
-	return (d + clockRate>>1) / clockRate * clockRate
+// clockRound returns d rounded to the nearest res increment.
+func clockRound(d, res time.Duration) time.Duration {
+	return (d + res>>1) / res * res
 }
 
 // round returns x rounded to the nearest int64 (non-negative values only).